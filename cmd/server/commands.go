@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jbonachera/weathercontroller/config"
+)
+
+// Commands run once the configuration is loaded, then exit. The
+// configuration database is locked by the running service, which must be
+// stopped first: revisions can also be listed, shown and rolled back over
+// MQTT while it runs.
+var (
+	showConfig    = flag.Bool("show-config", false, "print the effective configuration and the source of each value, then exit")
+	listRevisions = flag.Bool("revisions", false, "list the saved configuration revisions, then exit")
+	showRevision  = flag.Uint64("revision", 0, "print a saved configuration revision, then exit")
+	rollbackTo    = flag.Uint64("rollback", 0, "roll the configuration back to a saved revision, then exit")
+)
+
+// runCommand runs the command given on the command line, if any, and tells
+// whether one was run.
+func runCommand() (bool, error) {
+	switch {
+	case *showConfig:
+		fmt.Println(config.Describe())
+	case *listRevisions:
+		revisions, err := config.Revisions()
+		if err != nil {
+			return true, err
+		}
+		for _, revision := range revisions {
+			fmt.Println(revision.Seq, revision.Timestamp.Format("2006-01-02T15:04:05Z07:00"), revision.Source, string(revision.Diff))
+		}
+	case *showRevision > 0:
+		revision, err := config.GetRevision(*showRevision)
+		if err != nil {
+			return true, err
+		}
+		buf, _ := json.MarshalIndent(revision, "", "  ")
+		fmt.Println(string(buf))
+	case *rollbackTo > 0:
+		if err := config.LoadRevision(*rollbackTo); err != nil {
+			return true, err
+		}
+		if err := config.Save(config.RevisionCLI); err != nil {
+			return true, err
+		}
+		fmt.Println("configuration rolled back to revision", *rollbackTo)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -1,15 +1,80 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/jbonachera/weathercontroller/config"
 	"github.com/jbonachera/weathercontroller/homie"
 	"github.com/jbonachera/weathercontroller/log"
+	"github.com/jbonachera/weathercontroller/ota"
 	"github.com/jbonachera/weathercontroller/radio"
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
+var logger = log.Named("main")
+
+const (
+	// mqttRetryDelay is the delay before trying again to start the mqtt
+	// subsystem, doubled after each failure up to maxMQTTRetryDelay.
+	mqttRetryDelay    = 30 * time.Second
+	maxMQTTRetryDelay = 10 * time.Minute
+)
+
+var (
+	dataDir    = flag.String("data-dir", config.DataDir(), "directory holding the configuration database, also set by "+config.DataDirEnv)
+	configFile = flag.String("config", os.Getenv(config.ConfigFileEnv), "YAML, TOML or JSON configuration file, also set by "+config.ConfigFileEnv)
+)
+
+// loadConfig loads the configuration sources, from the lowest to the
+// highest precedence: defaults, file, environment, flags and the remote
+// overrides saved in the database.
+func loadConfig() error {
+	config.LoadDefaults()
+	if *configFile != "" {
+		if err := config.LoadFile(*configFile); err != nil {
+			return err
+		}
+	}
+	if err := config.LoadEnv(os.Environ()); err != nil {
+		return err
+	}
+	if err := config.LoadFlags(flag.CommandLine); err != nil {
+		return err
+	}
+	if err := config.ValidateLoaded(); err != nil {
+		return err
+	}
+	if err := config.Open(config.DBPath(*dataDir), log.Named("config")); err != nil {
+		return err
+	}
+	config.LoadPersisted()
+	return nil
+}
+
+// reloadConfig reloads the configuration file, and applies the changes to
+// the affected subsystems only. The running configuration is kept if the
+// file is invalid or a subsystem rejects it.
+func reloadConfig() {
+	if *configFile == "" {
+		logger.Warn("no configuration file to reload")
+		return
+	}
+	logger.Info("reloading configuration file ", *configFile)
+	if err := config.Update(config.RevisionReload, func() error {
+		return config.LoadFile(*configFile)
+	}); err != nil {
+		logger.Error("configuration file not reloaded, keeping the running configuration: ", err)
+		return
+	}
+	logger.Info("configuration file ", *configFile, " reloaded")
+}
+
 func floatToString(i float32) string {
 	str := strconv.FormatFloat(float64(i), 'f', 2, 64)
 	return str
@@ -18,19 +83,98 @@ func intToString(i int32) string {
 	str := strconv.Itoa(int(i))
 	return str
 }
+func radioSettings(format config.RadioFormat) radio.Settings {
+	return radio.Settings{
+		NetworkId:     format.NetworkID,
+		ClientId:      format.ClientID,
+		Frequency:     format.Frequency,
+		EncryptionKey: format.EncryptionKey,
+		Promiscuous:   format.Promiscuous,
+		Ack:           format.Ack,
+	}
+}
+
+// configureLogging applies the log section. Nothing is applied if a
+// setting is rejected, such as a sink path that cannot be written.
+func configureLogging(homieClient homie.Client) error {
+	levels := config.LogLevel()
+	for name, level := range config.LogLevels() {
+		levels += "," + name + "=" + level
+	}
+	policy, err := log.ParseOverflowPolicy(config.LogOverflow())
+	if err != nil {
+		return err
+	}
+	remote := config.RemoteLog()
+	severity, err := log.ParseSeverity(remote.Level)
+	if remote.Enabled && err != nil {
+		return errors.New("invalid remote log level: " + err.Error())
+	}
+	sinks, err := config.LogSinks()
+	if err != nil {
+		return err
+	}
+	if err := log.ReplaceLevels(levels); err != nil {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+		return err
+	}
+	log.SetOverflowPolicy(policy)
+	log.SetHistorySize(config.LogHistory())
+	log.SetDeduplication(config.LogDedupWindow())
+	log.SetRateLimits(config.LogRateLimits())
+	log.SetSinks(sinks...)
+	if !remote.Enabled {
+		log.StopRemote()
+		return nil
+	}
+	log.SetRemote(severity, remote.Rate, func(msg log.Message) {
+		homieClient.PublishLog(log.Format(msg))
+	})
+	return nil
+}
+
 func main() {
-	log.Info("main process starting")
+	config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	firmwareVersion := buildVersion()
+	logger.Info("main process starting, version ", firmwareVersion)
+	// signals are registered before any subsystem starts, so that they do
+	// not kill the process during startup: they are handled once it is done
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt, os.Kill)
-	config.LoadPersisted()
-	log.SetLevel(log.DEBUG)
-	homieClient := homie.NewClient(config.Prefix(), config.Host(), config.Port(), config.MQTTPrefix(), config.Ssl(), config.SSLConfig().CA, config.SSLConfig().ClientCert, config.SSLConfig().Privkey, config.HomieName(), "weatherStation")
-	radioClient := radio.NewClient(100, 1, func(sensorId byte, metric radio.Metric) {
+	levelc := make(chan os.Signal, 1)
+	signal.Notify(levelc, syscall.SIGUSR1, syscall.SIGUSR2)
+	reloadc := make(chan os.Signal, 1)
+	signal.Notify(reloadc, syscall.SIGHUP)
+	if err := loadConfig(); err != nil {
+		if err == config.ErrLocked {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logger.Fatal(err)
+	}
+	if ran, err := runCommand(); ran {
+		config.Stop()
+		log.Flush()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := config.Save(config.RevisionStartup); err != nil {
+		logger.Error("could not save configuration: ", err)
+	}
+	homieClient := homie.NewClient(config.Prefix(), config.Host(), config.Port(), config.MQTTPrefix(), config.Ssl(), config.SSLConfig().CA, config.SSLConfig().ClientCert, config.SSLConfig().Privkey, config.HomieName(), "weatherStation", firmwareVersion, log.Named("homie"))
+	radioClient := radio.NewClient(radioSettings(config.Radio()), func(correlationId string, sensorId byte, metric radio.Metric) {
+		entry := logger.WithFields(log.Fields{log.CorrelationKey: correlationId, "sensor": sensorId})
 		nodes := homieClient.Nodes()
 		strNodeId := strconv.Itoa(int(sensorId))
 		node, found := nodes[strNodeId]
 		if !found {
-			log.Info("discovered new sensor: ", sensorId)
+			entry.Info("discovered new sensor")
 			homieClient.AddNode(strNodeId, "weather_sensor",
 				[]string{
 					"temperature",
@@ -47,39 +191,190 @@ func main() {
 			)
 			node = nodes[strNodeId]
 		}
-		log.Info("Sensor ", sensorId, ": "+metric.Dump())
-		node.Set("temperature", floatToString(metric.Temperature))
-		node.Set("humidity", floatToString(metric.Humidity))
-		node.Set("pressure", floatToString(metric.Pressure))
-		node.Set("battery", floatToString(metric.Battery))
-		node.Set("rssi", intToString(metric.RSSI))
-		node.Set("uptime", intToString(metric.Uptime))
+		entry.Info(metric.Dump())
+		node.Set(correlationId, "temperature", floatToString(metric.Temperature))
+		node.Set(correlationId, "humidity", floatToString(metric.Humidity))
+		node.Set(correlationId, "pressure", floatToString(metric.Pressure))
+		node.Set(correlationId, "battery", floatToString(metric.Battery))
+		node.Set(correlationId, "rssi", intToString(metric.RSSI))
+		node.Set(correlationId, "uptime", intToString(metric.Uptime))
 
-	})
-	homieClient.AddConfigCallback(func(payload string) {
-		log.Debug("config changeset: ", payload)
-		config.MergeJSONString(payload)
-		log.Debug("new config: ", config.Dump())
-		homieClient.Reconfigure(config.Prefix(), config.Host(), config.Port(), config.MQTTPrefix(), config.Ssl(), config.SSLConfig(), config.HomieName())
-		config.Save()
-	})
-	go homieClient.Start()
-	go radioClient.Start("azertyuiopqsdfgh", "433")
-	defer func() {
+	}, log.Named("radio"))
+	stop := func() {
 		homieClient.Stop()
 		radioClient.Stop()
 		config.Stop()
+	}
+	log.AddShutdownHook(stop)
+	shutdown := func() {
+		stop()
 		log.Flush()
+	}
+	updater := ota.NewUpdater(firmwareVersion, config.OTAPublicKey(), func(status string) {
+		homieClient.Publish("$implementation/ota/status", status)
+	}, func(executable string) {
+		shutdown()
+		if err := syscall.Exec(executable, os.Args, os.Environ()); err != nil {
+			fmt.Fprintln(os.Stderr, "could not restart", executable+":", err)
+			os.Exit(1)
+		}
+	})
+	homieClient.Subscribe("$implementation/ota/set", func(path string, payload string) {
+		updater.Update(payload)
+	})
+	homieClient.Subscribe("$implementation/ota/chunk/set", func(path string, payload string) {
+		updater.Chunk(payload)
+	})
+	// authenticated subscribes handle to topic. Its requests change the
+	// configuration or disclose the logs and revisions, and require the same
+	// signature as changesets.
+	authenticated := func(topic string, handle func(payload string) error) {
+		homieClient.Subscribe(topic, func(path string, payload string) {
+			payload, err := config.Authenticate(topic, payload)
+			if err != nil {
+				logger.Error("request on ", topic, " rejected: ", err)
+				return
+			}
+			if err := handle(payload); err != nil {
+				logger.Error(err)
+			}
+		})
+	}
+	authenticated("$implementation/log/level/set", func(payload string) error {
+		if err := log.SetLevels(payload); err != nil {
+			return errors.New("invalid log levels: " + err.Error())
+		}
+		logger.Info("log levels changed: ", log.Levels())
+		homieClient.Publish("$implementation/log/level", log.Levels())
+		return nil
+	})
+	authenticated("$implementation/log/query/set", func(payload string) error {
+		query, err := log.ParseQuery(payload)
+		if err != nil {
+			return err
+		}
+		homieClient.PublishTransient("$implementation/log/query", log.EncodeJSON(log.Recent(query)))
+		return nil
+	})
+	config.Subscribe(func(previous config.Format, current config.Format) error {
+		return homieClient.Reconfigure(current.Homie.Prefix, current.Mqtt.Host, current.Mqtt.Port, current.Mqtt.Prefix, current.Mqtt.Ssl, current.Mqtt.Ssl_Config, current.Homie.Name)
+	}, config.SectionMQTT, config.SectionHomie)
+	config.Subscribe(func(previous config.Format, current config.Format) error {
+		return radioClient.Reconfigure(radioSettings(current.Radio))
+	}, config.SectionRadio)
+	config.Subscribe(func(previous config.Format, current config.Format) error {
+		return configureLogging(homieClient)
+	}, config.SectionLog)
+	config.Subscribe(func(previous config.Format, current config.Format) error {
+		updater.Reconfigure(current.Ota.PublicKey)
+		return nil
+	}, config.SectionOTA)
+	config.Subscribe(func(previous config.Format, current config.Format) error {
+		homieClient.PublishConfig(config.Sanitized())
+		return nil
+	})
+	homieClient.AddConfigCallback(func(payload string) error {
+		changeset, err := config.Authenticate("$implementation/config/set", payload)
+		if err != nil {
+			return err
+		}
+		logger.Debug("config changeset: ", config.Redact(changeset))
+		return config.Update(config.RevisionMQTT, func() error {
+			return config.ApplyChangeset(changeset)
+		})
+	})
+	authenticated("$implementation/config/revisions/set", func(payload string) error {
+		revisions, err := config.Revisions()
+		if err != nil {
+			return errors.New("could not list configuration revisions: " + err.Error())
+		}
+		buf, _ := json.Marshal(revisions)
+		homieClient.PublishTransient("$implementation/config/revisions", string(buf))
+		return nil
+	})
+	authenticated("$implementation/config/revision/set", func(payload string) error {
+		seq, err := strconv.ParseUint(payload, 10, 64)
+		if err != nil {
+			return errors.New("invalid configuration revision: " + payload)
+		}
+		revision, err := config.GetRevision(seq)
+		if err != nil {
+			return err
+		}
+		buf, _ := json.Marshal(revision)
+		homieClient.PublishTransient("$implementation/config/revision", string(buf))
+		return nil
+	})
+	authenticated("$implementation/config/rollback/set", func(payload string) error {
+		seq, err := strconv.ParseUint(payload, 10, 64)
+		if err != nil {
+			return errors.New("invalid configuration revision: " + payload)
+		}
+		if err := config.Update(config.RevisionRollback, func() error {
+			return config.LoadRevision(seq)
+		}); err != nil {
+			return errors.New("could not roll configuration back to revision " + payload + ": " + err.Error())
+		}
+		logger.Info("configuration rolled back to revision ", seq)
+		return nil
+	})
+	homieClient.PublishConfig(config.Sanitized())
+	if err := configureLogging(homieClient); err != nil {
+		logger.Error("could not configure logging: ", err)
+	}
+	homieClient.Publish("$implementation/log/level", log.Levels())
+	homieClient.AddStatsProvider("log", func() map[string]string {
+		return log.Stats().Map()
+	})
+	if updater.Crashed() {
+		updater.Rollback(errors.New("version " + firmwareVersion + " exited before reaching the MQTT server"))
+	}
+	go func() {
+		// the server may be unreachable for a while, such as after a power
+		// outage: keep trying, less and less often
+		retryDelay := mqttRetryDelay
+		for {
+			err := homieClient.Start()
+			if err == nil {
+				break
+			}
+			if updater.Pending() {
+				updater.Rollback(err)
+			}
+			logger.Error("could not start mqtt subsystem, retrying in ", retryDelay, ": ", err)
+			time.Sleep(retryDelay)
+			if retryDelay *= 2; retryDelay > maxMQTTRetryDelay {
+				retryDelay = maxMQTTRetryDelay
+			}
+		}
+		updater.Confirm()
+	}()
+	go func() {
+		if err := radioClient.Start(); err != nil {
+			logger.Error("could not start radio subsystem: ", err)
+		}
+	}()
+	defer func() {
 		if r := recover(); r != nil {
-			log.Fatal("Unknown error occured")
-			log.Fatal(r)
-			panic("")
+			logger.Fatal("Unknown error occured: ", r)
 		}
+		shutdown()
 	}()
-	select {
-	case <-sigc:
-		log.Warn("received interrupt - aborting operations")
-		break
+	for run := true; run; {
+		select {
+		case sig := <-levelc:
+			if sig == syscall.SIGUSR1 {
+				log.IncreaseVerbosity()
+			} else {
+				log.DecreaseVerbosity()
+			}
+			logger.Info("log levels changed: ", log.Levels())
+		case <-reloadc:
+			reloadConfig()
+		case <-sigc:
+			logger.Warn("received interrupt - aborting operations")
+			run = false
+		}
 	}
-	log.Info("main process finished")
+	logger.Info("main process finished")
 }
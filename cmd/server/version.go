@@ -0,0 +1,16 @@
+package main
+
+import "runtime/debug"
+
+// version is set at build time, with -ldflags "-X main.version=1.2.0"
+var version = ""
+
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureNone    = ""
+	SignatureHMAC    = "hmac"
+	SignatureEd25519 = "ed25519"
+
+	defaultMaxSkew = 300
+)
+
+/*
+ A signed changeset wraps the JSON changeset:
+ {
+   "payload": "{\"mqtt\": {\"host\": \"192.0.2.1\"}}",
+   "timestamp": 1514764800,
+   "nonce": "3f0a2c",
+   "signature": "base64 signature of <topic>\n<timestamp>\n<nonce>\n<payload>"
+ }
+ The topic is the one the changeset is sent to, such as
+ $implementation/config/set, so that it cannot be sent again to another.
+*/
+
+type SignedChangeset struct {
+	Topic     string `json:"topic,omitempty"`
+	Payload   string `json:"payload"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
+var seenNonces = map[string]int64{}
+var seenNoncesLock sync.Mutex
+
+// SigningString returns the data covered by the changeset signature.
+func (changeset SignedChangeset) SigningString() []byte {
+	return []byte(changeset.Topic + "\n" + strconv.FormatInt(changeset.Timestamp, 10) + "\n" + changeset.Nonce + "\n" + changeset.Payload)
+}
+
+// SignHMAC signs the changeset with the given HMAC-SHA256 shared secret.
+func (changeset *SignedChangeset) SignHMAC(secret string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(changeset.SigningString())
+	changeset.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignEd25519 signs the changeset with the given Ed25519 private key.
+func (changeset *SignedChangeset) SignEd25519(key ed25519.PrivateKey) {
+	changeset.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, changeset.SigningString()))
+}
+
+// Authenticate checks a changeset received on topic against the configured
+// signature policy, and returns the JSON changeset to merge. When no
+// signature is required, the payload is returned as is.
+func Authenticate(topic string, payload string) (string, error) {
+	security := loaded().Security
+	if security.Signature == SignatureNone {
+		return payload, nil
+	}
+	changeset := SignedChangeset{}
+	if err := json.Unmarshal([]byte(payload), &changeset); err != nil {
+		return "", errors.New("changeset is not signed: " + err.Error())
+	}
+	// the signature must cover the topic the changeset was received on
+	changeset.Topic = topic
+	if changeset.Signature == "" || changeset.Nonce == "" {
+		return "", errors.New("changeset is not signed")
+	}
+	signature, err := base64.StdEncoding.DecodeString(changeset.Signature)
+	if err != nil {
+		return "", errors.New("invalid changeset signature encoding")
+	}
+	switch security.Signature {
+	case SignatureHMAC:
+		if security.HMACSecret == "" {
+			return "", errors.New("hmac signature required but no secret is configured")
+		}
+		mac := hmac.New(sha256.New, []byte(security.HMACSecret))
+		mac.Write(changeset.SigningString())
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "", errors.New("invalid changeset signature")
+		}
+	case SignatureEd25519:
+		key, err := base64.StdEncoding.DecodeString(security.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return "", errors.New("ed25519 signature required but no valid public key is configured")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), changeset.SigningString(), signature) {
+			return "", errors.New("invalid changeset signature")
+		}
+	default:
+		return "", errors.New("unknown signature scheme: " + security.Signature)
+	}
+	if err := checkReplay(changeset, security.MaxSkew); err != nil {
+		return "", err
+	}
+	return changeset.Payload, nil
+}
+
+// checkReplay rejects changesets outside of the accepted time window, and
+// changesets whose nonce was already used inside this window.
+func checkReplay(changeset SignedChangeset, maxSkew int) error {
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxSkew
+	}
+	now := time.Now().Unix()
+	skew := now - changeset.Timestamp
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > int64(maxSkew) {
+		return errors.New("changeset timestamp is outside of the accepted window")
+	}
+	seenNoncesLock.Lock()
+	defer seenNoncesLock.Unlock()
+	for nonce, timestamp := range seenNonces {
+		if now-timestamp > int64(maxSkew) {
+			delete(seenNonces, nonce)
+		}
+	}
+	if _, found := seenNonces[changeset.Nonce]; found {
+		return errors.New("changeset nonce was already used")
+	}
+	seenNonces[changeset.Nonce] = changeset.Timestamp
+	return nil
+}
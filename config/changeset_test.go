@@ -0,0 +1,94 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedPayload(t *testing.T, changeset SignedChangeset) string {
+	buf, err := json.Marshal(changeset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// nonce returns a nonce unique to this test run.
+func nonce(name string) string {
+	return name + "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func TestAuthenticateUnsigned(t *testing.T) {
+	LoadDefaults()
+	payload, err := Authenticate("$implementation/config/set", `{"mqtt": {"port": 8883}}`)
+	if err != nil || payload != `{"mqtt": {"port": 8883}}` {
+		t.Error("Authenticate should accept unsigned changesets when no signature is required: got ", err)
+	}
+	store.Security = SecurityFormat{Signature: SignatureHMAC, HMACSecret: "secret"}
+	if _, err := Authenticate("$implementation/config/set", `{"mqtt": {"port": 8883}}`); err == nil {
+		t.Error("Authenticate should reject unsigned changesets when a signature is required")
+	}
+}
+
+func TestAuthenticateHMAC(t *testing.T) {
+	LoadDefaults()
+	store.Security = SecurityFormat{Signature: SignatureHMAC, HMACSecret: "secret"}
+	changeset := SignedChangeset{Payload: `{"mqtt": {"port": 8883}}`, Timestamp: time.Now().Unix(), Nonce: nonce("hmac-1"), Topic: "$implementation/config/set"}
+	changeset.SignHMAC("secret")
+	payload, err := Authenticate("$implementation/config/set", signedPayload(t, changeset))
+	if err != nil || payload != changeset.Payload {
+		t.Error("Authenticate should accept a valid HMAC signature: got ", err)
+	}
+	if _, err := Authenticate("$implementation/config/set", signedPayload(t, changeset)); err == nil {
+		t.Error("Authenticate should reject a replayed changeset")
+	}
+	forged := SignedChangeset{Payload: `{"mqtt": {"port": 8883}}`, Timestamp: time.Now().Unix(), Nonce: nonce("hmac-2"), Topic: "$implementation/config/set"}
+	forged.SignHMAC("not the secret")
+	if _, err := Authenticate("$implementation/config/set", signedPayload(t, forged)); err == nil {
+		t.Error("Authenticate should reject an invalid HMAC signature")
+	}
+	stale := SignedChangeset{Payload: `{"mqtt": {"port": 8883}}`, Timestamp: time.Now().Add(-time.Hour).Unix(), Nonce: nonce("hmac-3"), Topic: "$implementation/config/set"}
+	stale.SignHMAC("secret")
+	if _, err := Authenticate("$implementation/config/set", signedPayload(t, stale)); err == nil {
+		t.Error("Authenticate should reject a changeset outside of the accepted window")
+	}
+}
+
+func TestAuthenticateEd25519(t *testing.T) {
+	LoadDefaults()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Security = SecurityFormat{Signature: SignatureEd25519, PublicKey: base64.StdEncoding.EncodeToString(public)}
+	changeset := SignedChangeset{Payload: `{"homie": {"name": "shed"}}`, Timestamp: time.Now().Unix(), Nonce: nonce("ed25519-1"), Topic: "$implementation/config/set"}
+	changeset.SignEd25519(private)
+	payload, err := Authenticate("$implementation/config/set", signedPayload(t, changeset))
+	if err != nil || payload != changeset.Payload {
+		t.Error("Authenticate should accept a valid Ed25519 signature: got ", err)
+	}
+	changeset.Nonce = nonce("ed25519-2")
+	if _, err := Authenticate("$implementation/config/set", signedPayload(t, changeset)); err == nil {
+		t.Error("Authenticate should reject a changeset modified after signature")
+	}
+}
+
+func TestAuthenticateTopic(t *testing.T) {
+	LoadDefaults()
+	store.Security = SecurityFormat{Signature: SignatureHMAC, HMACSecret: "secret"}
+	changeset := SignedChangeset{Topic: "$implementation/config/revision/set", Payload: "5", Timestamp: time.Now().Unix(), Nonce: nonce("topic-1")}
+	changeset.SignHMAC("secret")
+	if _, err := Authenticate("$implementation/config/rollback/set", signedPayload(t, changeset)); err == nil {
+		t.Error("Authenticate should reject a changeset signed for another topic")
+	}
+	changeset.Nonce = nonce("topic-2")
+	changeset.SignHMAC("secret")
+	changeset.Topic = ""
+	if _, err := Authenticate("$implementation/config/revision/set", signedPayload(t, changeset)); err != nil {
+		t.Error("Authenticate should accept a changeset signed for the topic it is received on: got ", err)
+	}
+}
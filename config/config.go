@@ -3,13 +3,15 @@ package config
 import (
 	"encoding/json"
 	"errors"
-	"github.com/boltdb/bolt"
+	"fmt"
 	"github.com/jbonachera/weathercontroller/log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
-const (
-	datadir = "/var/lib/weathercontroller/config.db"
-)
+const redacted = "<redacted>"
 
 /*
  {
@@ -21,7 +23,52 @@ const (
    },
    "homie": {
      "name:" "weatherController"
-    }
+    },
+   "radio": {
+     "network_id": 100,
+     "client_id": 1,
+     "frequency": "433",
+     "encryption_key": "16 bytes AES key",
+     "promiscuous": true,
+     "ack": true
+   },
+   "log": {
+     "level": "info",
+     "levels": {
+       "homie": "trace",
+       "radio": "warn"
+     },
+     "format": "json",
+     "overflow": "drop_below",
+     "overflow_level": "warn",
+     "history": 500,
+     "dedup_window": 10,
+     "rate_limits": {
+       "radio": 20
+     },
+     "sinks": [
+       {"type": "stdout", "level": "info"},
+       {"type": "file", "path": "/var/log/weathercontroller.log", "max_size": 10, "max_age": 24, "max_backups": 7},
+       {"type": "syslog", "tag": "weathercontroller", "format": "logfmt"},
+       {"type": "journald", "level": "debug"}
+     ],
+     "remote": {
+       "enabled": true,
+       "level": "warn",
+       "rate": 5
+     }
+   },
+   "ota": {
+     "public_key": "base64 encoded key"
+   },
+   "revisions": {
+     "retention": 20
+   },
+   "security": {
+     "signature": "ed25519",
+     "public_key": "base64 encoded key",
+     "max_skew": 300
+   }
  }
 */
 
@@ -32,7 +79,7 @@ type HomieFormat struct {
 type TLSFormat struct {
 	CA         string `json:"ca"`
 	ClientCert string `json:"client_cert"`
-	Privkey    string `json:"privkey"`
+	Privkey    string `json:"privkey" secret:"true"`
 }
 type MQTTFormat struct {
 	Prefix     string    `json:"prefix,omitempty"`
@@ -41,17 +88,102 @@ type MQTTFormat struct {
 	Ssl        bool      `json:"ssl,omitempty"`
 	Ssl_Config TLSFormat `json:"ssl_config,omitempty"`
 }
+type SecurityFormat struct {
+	Signature  string `json:"signature,omitempty"`
+	HMACSecret string `json:"hmac_secret,omitempty" secret:"true"`
+	PublicKey  string `json:"public_key,omitempty"`
+	MaxSkew    int    `json:"max_skew,omitempty"`
+}
+type RemoteLogFormat struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Rate    int    `json:"rate,omitempty"`
+}
+type LogSinkFormat struct {
+	Type       string `json:"type"`
+	Level      string `json:"level,omitempty"`
+	Format     string `json:"format,omitempty"`
+	Path       string `json:"path,omitempty"`
+	MaxSize    int    `json:"max_size,omitempty"`
+	MaxAge     int    `json:"max_age,omitempty"`
+	MaxBackups int    `json:"max_backups,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+type LogFormat struct {
+	Level         string            `json:"level,omitempty"`
+	Levels        map[string]string `json:"levels,omitempty"`
+	Format        string            `json:"format,omitempty"`
+	Overflow      string            `json:"overflow,omitempty"`
+	OverflowLevel string            `json:"overflow_level,omitempty"`
+	History       int               `json:"history,omitempty"`
+	DedupWindow   int               `json:"dedup_window,omitempty"`
+	RateLimits    map[string]int    `json:"rate_limits,omitempty"`
+	Sinks         []LogSinkFormat   `json:"sinks,omitempty"`
+	Remote        RemoteLogFormat   `json:"remote,omitempty"`
+}
+type RadioFormat struct {
+	NetworkID     int    `json:"network_id"`
+	ClientID      int    `json:"client_id"`
+	Frequency     string `json:"frequency,omitempty"`
+	EncryptionKey string `json:"encryption_key,omitempty" secret:"true"`
+	Promiscuous   bool   `json:"promiscuous"`
+	Ack           bool   `json:"ack"`
+}
+type RevisionsFormat struct {
+	// Retention is the number of revisions kept, or 0 to keep them all.
+	Retention int `json:"retention,omitempty"`
+}
+type OTAFormat struct {
+	PublicKey string `json:"public_key,omitempty"`
+}
 type Format struct {
-	Mqtt  MQTTFormat  `json:"mqtt,omitempty"`
-	Homie HomieFormat `json:"homie,omitempty"`
+	Mqtt      MQTTFormat      `json:"mqtt,omitempty"`
+	Homie     HomieFormat     `json:"homie,omitempty"`
+	Radio     RadioFormat     `json:"radio,omitempty"`
+	Security  SecurityFormat  `json:"security,omitempty"`
+	Log       LogFormat       `json:"log,omitempty"`
+	Ota       OTAFormat       `json:"ota,omitempty"`
+	Revisions RevisionsFormat `json:"revisions,omitempty"`
 }
 
 var store Format = Format{}
-var db *bolt.DB = nil
+var logger = log.Named("config")
+
+// storeLock guards store, layers, provenance and subscriptions. They are
+// replaced as a whole on each change, and never modified in place, so that
+// readers can keep the values returned by loaded and loadedLayers.
+var storeLock sync.RWMutex
+
+// loaded returns the running configuration.
+func loaded() Format {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return store
+}
 
+// SetLogger replaces the logger used by the config package.
+func SetLogger(l *log.Logger) {
+	logger = l
+}
+
+// LoadDefaults resets the configuration to its defaults, discarding the
+// values set by every other source.
 func LoadDefaults() {
-	log.Debug("loading default configuration")
-	store = Format{
+	logger.Debug("loading default configuration")
+	layer, _ := toTree(defaultConfig())
+	defaults := map[string]tree{SourceDefault: layer}
+	result, sources, err := build(defaults, true)
+	if err != nil {
+		logger.Error("invalid default configuration: ", err)
+		return
+	}
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	layers, store, provenance = defaults, result, sources
+}
+
+func defaultConfig() Format {
+	return Format{
 		Mqtt: MQTTFormat{
 			Prefix: "",
 			Host:   "172.20.0.100",
@@ -67,97 +199,256 @@ func LoadDefaults() {
 			Name:   "weatherController",
 			Prefix: "devices/",
 		},
+		Radio: RadioFormat{
+			NetworkID:     100,
+			ClientID:      1,
+			Frequency:     "433",
+			EncryptionKey: "azertyuiopqsdfgh",
+			Promiscuous:   true,
+			Ack:           true,
+		},
+		Log: LogFormat{
+			Level:         "debug",
+			Format:        "text",
+			Overflow:      "block",
+			OverflowLevel: "warn",
+			History:       500,
+			DedupWindow:   10,
+			Sinks: []LogSinkFormat{
+				{Type: "stdout"},
+			},
+			Remote: RemoteLogFormat{
+				Enabled: false,
+				Level:   "warn",
+				Rate:    5,
+			},
+		},
+		Revisions: RevisionsFormat{
+			Retention: 20,
+		},
 	}
 }
 
-func MergeJSONString(payload string) {
-	if err := json.Unmarshal([]byte(payload), &store); err != nil {
-		log.Error(err)
+// MergeJSONString applies a JSON changeset on top of the remote overrides,
+// as a JSON Merge Patch.
+func MergeJSONString(payload string) error {
+	return MergePatch(payload)
+}
+
+// clone returns a deep copy of a configuration, so that its maps and slices
+// can be modified without altering the original.
+func clone(source Format) Format {
+	copied := Format{}
+	buf, _ := json.Marshal(source)
+	json.Unmarshal(buf, &copied)
+	return copied
+}
+
+// Current returns a copy of the running configuration.
+func Current() Format {
+	return clone(loaded())
+}
+
+// State is a copy of the configuration and of the values set by each
+// source, returned by Checkpoint.
+type State struct {
+	store      Format
+	layers     map[string]tree
+	provenance map[string]string
+}
+
+// Checkpoint returns a copy of the configuration, to be restored with
+// Restore.
+func Checkpoint() State {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	state := State{store: clone(store), layers: map[string]tree{}, provenance: map[string]string{}}
+	for name, layer := range layers {
+		state.layers[name] = copyTree(layer)
+	}
+	for path, source := range provenance {
+		state.provenance[path] = source
+	}
+	return state
+}
+
+// Restore replaces the configuration with a copy returned by Checkpoint.
+func Restore(previous State) {
+	restored := State{store: clone(previous.store), layers: map[string]tree{}, provenance: map[string]string{}}
+	for name, layer := range previous.layers {
+		restored.layers[name] = copyTree(layer)
+	}
+	for path, source := range previous.provenance {
+		restored.provenance[path] = source
 	}
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	store, layers, provenance = restored.store, restored.layers, restored.provenance
 }
 
+// Dump returns the running configuration, with secrets redacted.
 func Dump() string {
-	buf, _ := json.Marshal(store)
-	return string(buf)
+	return Sanitized()
 }
 
-func init() {
-	var err error
-	db, err = bolt.Open(datadir, 0600, nil)
-	if err != nil {
-		panic(err)
-	}
+// Sanitized returns the running configuration, with secrets redacted, so it
+// can be logged or published.
+func Sanitized() string {
+	buf, _ := json.Marshal(sanitized())
+	return string(buf)
 }
 
-func Stop() {
-	db.Close()
+func sanitized() Format {
+	sanitized := clone(loaded())
+	redactSecrets(reflect.ValueOf(&sanitized).Elem())
+	return sanitized
 }
 
-func Save() {
+// Save persists the remote overrides, secrets encrypted, and records the
+// running configuration as a revision, caused by source.
+func Save(source string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Fatal("Unknown error occured when saving config")
-			log.Fatal(r)
+			logger.Critical("Unknown error occured when saving config: ", r)
+			err = errors.New("could not save configuration: " + fmt.Sprint(r))
 		}
 	}()
-	log.Debug("updating saved configuration")
-	log.Debug("opening database")
-	log.Debug("aquiring r/w transaction")
-	db.Update(func(tx *bolt.Tx) error {
-		log.Debug("transaction aquired")
-		b := tx.Bucket([]byte("config"))
-		if b == nil {
-			var err error
-			b, err = tx.CreateBucket([]byte("config"))
-			if err != nil {
-				return err
-			}
-		}
-		buf, err := json.Marshal(store)
-		if err != nil {
-			return err
-		}
-		log.Debug("updating data")
-		return b.Put([]byte("store"), buf)
-	})
-	log.Debug("configuration updated")
+	if db == nil {
+		return errors.New("could not save configuration: database is not open")
+	}
+	if persistedSchema > SchemaVersion {
+		return errors.New("could not save configuration: the database was written by a newer version")
+	}
+	logger.Debug("updating saved remote configuration overrides")
+	buf, err := marshalEncrypted(loadedLayers()[SourceRemote])
+	if err != nil {
+		return err
+	}
+	if err := db.put("config", "store", buf); err != nil {
+		return err
+	}
+	if err := writeSchema(); err != nil {
+		return err
+	}
+	logger.Debug("configuration updated")
+	return saveRevision(source)
 }
 
+// LoadPersisted loads the saved remote overrides on top of the other
+// sources, after migrating them to SchemaVersion if needed. The defaults are
+// loaded first if needed.
 func LoadPersisted() {
-	if db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("config"))
-		if b != nil {
-			v := b.Get([]byte("store"))
-			json.Unmarshal(v, &store)
-			return nil
-		} else {
-			log.Warn("no persisted configuration found")
-			return errors.New("bucket 'config' not found")
-		}
-	}) != nil {
+	if _, found := loadedLayers()[SourceDefault]; !found {
 		LoadDefaults()
 	}
+	if db == nil {
+		logger.Warn("configuration database is not open: using defaults")
+		return
+	}
+	buf, err := db.get("config", "store")
+	if err != nil || len(buf) == 0 {
+		logger.Warn("no persisted configuration found")
+		return
+	}
+	remote, err := migratePersisted(buf)
+	if err != nil {
+		logger.Error("ignoring persisted configuration: ", err)
+		return
+	}
+	if err := setLayer(SourceRemote, pruneRemote(remote)); err != nil {
+		logger.Error("ignoring invalid persisted configuration: ", err)
+	}
+}
 
+// pruneRemote removes from the persisted remote overrides the values making
+// the configuration invalid, so that the other overrides are kept. The
+// overrides of a section are removed as a whole only when its error comes
+// from a combination of settings.
+func pruneRemote(remote tree) tree {
+	for {
+		candidate := map[string]tree{}
+		for name, layer := range loadedLayers() {
+			candidate[name] = layer
+		}
+		candidate[SourceRemote] = remote
+		_, _, err := build(candidate, true)
+		invalid, ok := err.(ValidationError)
+		if !ok {
+			return remote
+		}
+		pruned := false
+		for _, field := range invalid {
+			if remote.remove(field.Path) {
+				logger.Error("ignoring invalid persisted setting ", field.Error())
+				pruned = true
+			}
+		}
+		for _, field := range invalid {
+			section := strings.Split(field.Path, ".")[0]
+			if !pruned && remote.remove(section) {
+				logger.Error("ignoring persisted ", section, " settings: ", field.Error())
+				pruned = true
+			}
+		}
+		if !pruned {
+			return remote
+		}
+	}
 }
 
 func Ssl() bool {
-	return store.Mqtt.Ssl
+	return loaded().Mqtt.Ssl
 }
 func Host() string {
-	return store.Mqtt.Host
+	return loaded().Mqtt.Host
 }
 func Port() int {
-	return store.Mqtt.Port
+	return loaded().Mqtt.Port
 }
 func Prefix() string {
-	return store.Homie.Prefix
+	return loaded().Homie.Prefix
 }
 func HomieName() string {
-	return store.Homie.Name
+	return loaded().Homie.Name
 }
 func SSLConfig() TLSFormat {
-	return store.Mqtt.Ssl_Config
+	return loaded().Mqtt.Ssl_Config
 }
 func MQTTPrefix() string {
-	return store.Mqtt.Prefix
+	return loaded().Mqtt.Prefix
+}
+func Radio() RadioFormat {
+	return loaded().Radio
+}
+func RemoteLog() RemoteLogFormat {
+	return loaded().Log.Remote
+}
+func OTAPublicKey() string {
+	return loaded().Ota.PublicKey
+}
+func LogLevel() string {
+	return loaded().Log.Level
+}
+func LogLevels() map[string]string {
+	levels := map[string]string{}
+	for name, level := range loaded().Log.Levels {
+		levels[name] = level
+	}
+	return levels
+}
+func LogOverflow() (string, string) {
+	return loaded().Log.Overflow, loaded().Log.OverflowLevel
+}
+func LogHistory() int {
+	return loaded().Log.History
+}
+func LogDedupWindow() time.Duration {
+	return time.Duration(loaded().Log.DedupWindow) * time.Second
+}
+func LogRateLimits() map[string]int {
+	limits := map[string]int{}
+	for name, rate := range loaded().Log.RateLimits {
+		limits[name] = rate
+	}
+	return limits
 }
@@ -1,16 +1,92 @@
 package config
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestLoadDefaults(t *testing.T) {
 	LoadDefaults()
-	if store.Mqtt.Host != "iot.eclipse.org" {
-		t.Error("LoadDefaults should set the mqtt host to 'iot.eclipse.org': got ", store.Mqtt.Host)
+	if store.Mqtt.Host != "172.20.0.100" {
+		t.Error("LoadDefaults should set the mqtt host to '172.20.0.100': got ", store.Mqtt.Host)
 	}
 	if store.Mqtt.Port != 1883 {
 		t.Error("LoadDefaults should set the mqtt port to 1883: got ", store.Mqtt.Port)
 	}
-	if !store.Mqtt.Ssl {
-		t.Error("LoadDefaults should enable SSL: got SSL disabled")
+	if store.Mqtt.Ssl {
+		t.Error("LoadDefaults should disable SSL: got SSL enabled")
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal("Open should accept the in-memory mode: got ", err)
+	}
+	defer Stop()
+	LoadPersisted()
+	if err := MergeJSONString(`{"homie": {"name": "shed"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(RevisionCLI); err != nil {
+		t.Fatal("Save should keep the configuration in memory: got ", err)
+	}
+	LoadDefaults()
+	LoadPersisted()
+	if HomieName() != "shed" || Host() != "172.20.0.100" {
+		t.Error("LoadPersisted should load the saved configuration on top of the defaults: got ", HomieName(), " ", Host())
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := DBPath(filepath.Join(dir, "data"))
+	if err := Open(path, nil); err != nil {
+		t.Fatal("Open should create the data directory and the database: got ", err)
+	}
+	if err := Open(path, nil); err == nil {
+		t.Error("Open should fail when the database is already open")
+	}
+	LoadDefaults()
+	if err := MergeJSONString(`{"mqtt": {"port": 8883}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(RevisionCLI); err != nil {
+		t.Fatal(err)
+	}
+	Stop()
+	if err := Save(RevisionCLI); err == nil {
+		t.Error("Save should fail when the database is closed")
+	}
+	if err := Open(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadPersisted()
+	if Port() != 8883 {
+		t.Error("LoadPersisted should load the configuration saved in the database: got ", Port())
+	}
+}
+
+func TestLoadPersistedInvalid(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadDefaults()
+	if err := Save(RevisionCLI); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.put("config", "store", []byte(`{"homie": {"name": "shed"}, "radio": {"frequency": "2400", "client_id": 2}}`)); err != nil {
+		t.Fatal(err)
+	}
+	LoadPersisted()
+	if HomieName() != "shed" || Radio().ClientID != 2 || Radio().Frequency != "433" {
+		t.Error("LoadPersisted should only ignore the invalid persisted settings: got ", HomieName(), " ", Radio())
 	}
 }
@@ -0,0 +1,412 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sources of configuration values, from the lowest to the highest
+// precedence.
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+	SourceRemote  = "remote"
+)
+
+const (
+	// EnvPrefix prefixes the environment variables overriding settings, for
+	// example WEATHERCONTROLLER_MQTT_HOST for mqtt.host.
+	EnvPrefix = "WEATHERCONTROLLER_"
+	// ConfigFileEnv gives the path of the configuration file.
+	ConfigFileEnv = "WEATHERCONTROLLER_CONFIG"
+)
+
+var sourceOrder = []string{SourceDefault, SourceFile, SourceEnv, SourceFlag, SourceRemote}
+
+// tree is a decoded JSON object.
+type tree map[string]interface{}
+
+// layers holds the values set by each source, merged in sourceOrder to
+// build store. provenance tells which source each value of store comes from.
+var layers = map[string]tree{}
+var provenance = map[string]string{}
+
+// loadedLayers returns the values set by each source.
+func loadedLayers() map[string]tree {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return layers
+}
+
+// setting is a configuration value that can be set by the environment or a
+// flag, such as mqtt.host. Secret settings are tagged `secret:"true"`.
+type setting struct {
+	path   string
+	kind   reflect.Type
+	secret bool
+}
+
+// settings lists the values of Format. Maps and slices are settings as a
+// whole.
+func settings(typ reflect.Type, prefix string) []setting {
+	result := []setting{}
+	for idx := 0; idx < typ.NumField(); idx++ {
+		field := typ.Field(idx)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			result = append(result, settings(field.Type, prefix+name+".")...)
+		} else {
+			result = append(result, setting{path: prefix + name, kind: field.Type, secret: field.Tag.Get("secret") == "true"})
+		}
+	}
+	return result
+}
+
+// parse converts a value given as a string, by the environment or a flag.
+// Maps and slices are given as JSON.
+func (s setting) parse(raw string) (interface{}, error) {
+	switch s.kind.Kind() {
+	case reflect.String:
+		return raw, nil
+	case reflect.Int, reflect.Int64:
+		return strconv.Atoi(raw)
+	case reflect.Bool:
+		return strconv.ParseBool(raw)
+	default:
+		var value interface{}
+		err := json.Unmarshal([]byte(raw), &value)
+		return value, err
+	}
+}
+
+func (s setting) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(s.path, ".", "_", -1))
+}
+
+func toTree(value interface{}) (tree, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	result := tree{}
+	err = json.Unmarshal(buf, &result)
+	return result, err
+}
+
+func copyTree(source tree) tree {
+	if source == nil {
+		return tree{}
+	}
+	copied, _ := toTree(source)
+	return copied
+}
+
+func (t tree) set(path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := t[key].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			t[key] = child
+		}
+		t = child
+	}
+	t[keys[len(keys)-1]] = value
+}
+
+func (t tree) get(path string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(t)
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// remove deletes the value set at path, and returns whether there was one.
+func (t tree) remove(path string) bool {
+	keys := strings.Split(path, ".")
+	parent, found := t.get(strings.Join(keys[:len(keys)-1], "."))
+	if len(keys) == 1 {
+		parent, found = map[string]interface{}(t), true
+	}
+	object, ok := parent.(map[string]interface{})
+	if !found || !ok {
+		return false
+	}
+	if _, found := object[keys[len(keys)-1]]; !found {
+		return false
+	}
+	delete(object, keys[len(keys)-1])
+	return true
+}
+
+// merge copies source into destination, merging objects and replacing other
+// values. The source of each copied value is recorded in sources.
+func merge(destination map[string]interface{}, source map[string]interface{}, prefix string, name string, sources map[string]string) {
+	for key, value := range source {
+		path := prefix + key
+		object, isObject := value.(map[string]interface{})
+		existing, existingIsObject := destination[key].(map[string]interface{})
+		if isObject {
+			if !existingIsObject {
+				existing = map[string]interface{}{}
+				destination[key] = existing
+			}
+			merge(existing, object, path+".", name, sources)
+			continue
+		}
+		destination[key] = value
+		sources[path] = name
+	}
+}
+
+// mergeLayers merges candidate layers in sourceOrder, and returns the
+// source of each value.
+func mergeLayers(candidate map[string]tree) (map[string]interface{}, map[string]string) {
+	merged := map[string]interface{}{}
+	sources := map[string]string{}
+	for _, name := range sourceOrder {
+		if layer, found := candidate[name]; found {
+			merge(merged, copyTree(layer), "", name, sources)
+		}
+	}
+	return merged, sources
+}
+
+// build merges candidate layers into a configuration, validated if
+// validate is set.
+func build(candidate map[string]tree, validate bool) (Format, map[string]string, error) {
+	merged, sources := mergeLayers(candidate)
+	result := Format{}
+	if unknown := unknownSettings(merged); len(unknown) > 0 {
+		return result, nil, unknown
+	}
+	buf, err := json.Marshal(merged)
+	if err != nil {
+		return result, nil, err
+	}
+	if err := json.Unmarshal(buf, &result); err != nil {
+		return result, nil, decodeError(err)
+	}
+	if validate {
+		if err := Validate(result); err != nil {
+			return result, nil, err
+		}
+	}
+	return result, sources, nil
+}
+
+// setLayer replaces the values set by a source, and rebuilds the
+// configuration. Nothing changes if the result is invalid: a ValidationError
+// is returned as is, so that the invalid settings can be reported.
+func setLayer(name string, layer tree) error {
+	return replaceLayer(name, layer, true)
+}
+
+// loadLayer replaces the values set by a startup source, whose settings
+// may only be valid once combined with the other sources. The result is
+// checked by ValidateLoaded, once every source is loaded.
+func loadLayer(name string, layer tree) error {
+	return replaceLayer(name, layer, false)
+}
+
+func replaceLayer(name string, layer tree, validate bool) error {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	candidate := map[string]tree{}
+	for source, values := range layers {
+		candidate[source] = values
+	}
+	candidate[name] = layer
+	result, sources, err := build(candidate, validate)
+	if _, invalid := err.(ValidationError); invalid {
+		return err
+	}
+	if err != nil {
+		return errors.New("invalid " + name + " configuration: " + err.Error())
+	}
+	layers, store, provenance = candidate, result, sources
+	return nil
+}
+
+// LoadFile loads a YAML, TOML or JSON configuration file, depending on its
+// extension. Its values override the defaults.
+func LoadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("could not read configuration file: " + err.Error())
+	}
+	var decoded interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &decoded)
+		decoded = fromYAML(decoded)
+	case ".toml":
+		values := map[string]interface{}{}
+		_, err = toml.Decode(string(buf), &values)
+		decoded = values
+	case ".json":
+		err = json.Unmarshal(buf, &decoded)
+	default:
+		return errors.New("unknown configuration file format: " + path)
+	}
+	if err != nil {
+		return errors.New("could not parse configuration file " + path + ": " + err.Error())
+	}
+	layer, err := toTree(decoded)
+	if err != nil {
+		return errors.New("could not parse configuration file " + path + ": " + err.Error())
+	}
+	logger.Debug("loaded configuration file ", path)
+	return loadLayer(SourceFile, layer)
+}
+
+// fromYAML converts the maps decoded by yaml, keyed by interface{}, so that
+// they can be encoded as JSON.
+func fromYAML(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range typed {
+			converted[fmt.Sprint(key)] = fromYAML(item)
+		}
+		return converted
+	case []interface{}:
+		for idx, item := range typed {
+			typed[idx] = fromYAML(item)
+		}
+	}
+	return value
+}
+
+// LoadEnv loads the settings given as environment variables, in the format
+// of os.Environ. Their values override the configuration file.
+func LoadEnv(environ []string) error {
+	env := map[string]string{}
+	for _, entry := range environ {
+		if idx := strings.Index(entry, "="); idx > 0 {
+			env[entry[:idx]] = entry[idx+1:]
+		}
+	}
+	layer := tree{}
+	for _, s := range settings(reflect.TypeOf(Format{}), "") {
+		raw, found := env[s.envName()]
+		if !found {
+			continue
+		}
+		value, err := s.parse(raw)
+		if err != nil {
+			return errors.New("invalid value for " + s.envName() + ": " + err.Error())
+		}
+		layer.set(s.path, value)
+	}
+	return loadLayer(SourceEnv, layer)
+}
+
+// ValidateLoaded checks the configuration merged from every source loaded.
+func ValidateLoaded() error {
+	return Validate(loaded())
+}
+
+// RegisterFlags declares a flag for each setting, such as -mqtt.host, on fs.
+// Secret settings have no flag, since the command line can be read by any
+// local user: they are only set by the environment and the configuration
+// file.
+func RegisterFlags(fs *flag.FlagSet) {
+	for _, s := range settings(reflect.TypeOf(Format{}), "") {
+		if !s.secret {
+			fs.String(s.path, "", "override "+s.path+" (also "+s.envName()+")")
+		}
+	}
+}
+
+// LoadFlags loads the settings given on the command line, once fs is
+// parsed. Their values override the environment.
+func LoadFlags(fs *flag.FlagSet) error {
+	known := map[string]setting{}
+	for _, s := range settings(reflect.TypeOf(Format{}), "") {
+		if !s.secret {
+			known[s.path] = s
+		}
+	}
+	layer := tree{}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		s, found := known[f.Name]
+		if !found || err != nil {
+			return
+		}
+		value, parseErr := s.parse(f.Value.String())
+		if parseErr != nil {
+			err = errors.New("invalid value for -" + f.Name + ": " + parseErr.Error())
+			return
+		}
+		layer.set(s.path, value)
+	})
+	if err != nil {
+		return err
+	}
+	return loadLayer(SourceFlag, layer)
+}
+
+// Source returns the source of the effective value of a setting, such as
+// "mqtt.host".
+func Source(path string) string {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	if source, found := provenance[path]; found {
+		return source
+	}
+	rank := -1
+	for key, source := range provenance {
+		if strings.HasPrefix(key, path+".") {
+			for idx, name := range sourceOrder {
+				if name == source && idx > rank {
+					rank = idx
+				}
+			}
+		}
+	}
+	if rank < 0 {
+		return SourceDefault
+	}
+	return sourceOrder[rank]
+}
+
+// Describe lists each setting with its effective value and its source,
+// secrets redacted.
+func Describe() string {
+	sanitized, _ := toTree(sanitized())
+	lines := []string{}
+	for _, s := range settings(reflect.TypeOf(Format{}), "") {
+		value, found := sanitized.get(s.path)
+		if !found {
+			value = reflect.Zero(s.kind).Interface()
+		}
+		buf, _ := json.Marshal(value)
+		lines = append(lines, s.path+" = "+string(buf)+" ("+Source(s.path)+")")
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
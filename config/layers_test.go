@@ -0,0 +1,93 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	LoadDefaults()
+	files := map[string]string{
+		"config.yaml": "mqtt:\n  host: broker.example.org\n  port: 8883\nlog:\n  levels:\n    homie: trace\n",
+		"config.toml": "[mqtt]\nhost = \"broker.example.org\"\nport = 8883\n[log.levels]\nhomie = \"trace\"\n",
+		"config.json": `{"mqtt": {"host": "broker.example.org", "port": 8883}, "log": {"levels": {"homie": "trace"}}}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadFile(path); err != nil {
+			t.Fatal("LoadFile should load ", name, ": got ", err)
+		}
+		if Host() != "broker.example.org" || Port() != 8883 || LogLevels()["homie"] != "trace" || Source("mqtt.host") != SourceFile {
+			t.Error("LoadFile should override the defaults with ", name, ": got ", Host(), " ", Port(), " ", LogLevels())
+		}
+	}
+	if err := LoadEnv([]string{"WEATHERCONTROLLER_MQTT_PORT=1884", "WEATHERCONTROLLER_MQTT_SSL=true"}); err != nil {
+		t.Fatal(err)
+	}
+	if Port() != 1884 || !Ssl() || Source("mqtt.port") != SourceEnv || Source("mqtt.host") != SourceFile {
+		t.Error("LoadEnv should override the configuration file: got ", Port(), " from ", Source("mqtt.port"))
+	}
+	if err := LoadEnv([]string{"WEATHERCONTROLLER_MQTT_PORT=http"}); err == nil {
+		t.Error("LoadEnv should reject invalid values")
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if fs.Lookup("security.hmac_secret") != nil {
+		t.Error("RegisterFlags should not declare flags for secret settings")
+	}
+	if err := fs.Parse([]string{"-mqtt.port", "1885"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeJSONString(`{"homie": {"name": "shed"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if Port() != 1885 || Source("mqtt.port") != SourceFlag || HomieName() != "shed" || Source("homie.name") != SourceRemote {
+		t.Error("flags and remote overrides should take precedence: got ", Port(), " from ", Source("mqtt.port"))
+	}
+	if Source("log.levels") != SourceFile || Source("homie.prefix") != SourceDefault {
+		t.Error("Source should tell where each value comes from: got ", Source("log.levels"), " and ", Source("homie.prefix"))
+	}
+	if !strings.Contains(Describe(), `mqtt.port = 1885 (flag)`) {
+		t.Error("Describe should list values and their source: got ", Describe())
+	}
+}
+
+func TestLoadedValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("security:\n  signature: hmac\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	LoadDefaults()
+	if err := LoadFile(path); err != nil {
+		t.Fatal("LoadFile should not validate the file alone: got ", err)
+	}
+	if err := ValidateLoaded(); err == nil {
+		t.Error("ValidateLoaded should require the hmac secret")
+	}
+	if err := LoadEnv([]string{"WEATHERCONTROLLER_SECURITY_HMAC_SECRET=s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateLoaded(); err != nil {
+		t.Error("the file and the environment should be valid once merged: got ", err)
+	}
+}
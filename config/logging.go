@@ -0,0 +1,77 @@
+package config
+
+import (
+	"errors"
+	"github.com/jbonachera/weathercontroller/log"
+	"time"
+)
+
+const (
+	defaultLogTag = "weathercontroller"
+	megabyte      = 1024 * 1024
+)
+
+// LogSinks builds the log sinks described in the log section. A sink without
+// a format uses the format of the section, and a sink without a level
+// receives every message.
+func LogSinks() ([]log.Sink, error) {
+	specs := loaded().Log.Sinks
+	if len(specs) == 0 {
+		specs = []LogSinkFormat{{Type: "stdout"}}
+	}
+	sinks := []log.Sink{}
+	for _, spec := range specs {
+		sink, err := newLogSink(spec)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, errors.New("log sink " + spec.Type + ": " + err.Error())
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func newLogSink(spec LogSinkFormat) (log.Sink, error) {
+	format := spec.Format
+	if format == "" {
+		format = loaded().Log.Format
+	}
+	encoder, err := log.ParseEncoder(format)
+	if err != nil {
+		return nil, err
+	}
+	tag := spec.Tag
+	if tag == "" {
+		tag = defaultLogTag
+	}
+	var sink log.Sink
+	switch spec.Type {
+	case "stdout":
+		sink = log.NewStdoutSink(encoder)
+	case "file":
+		if spec.Path == "" {
+			return nil, errors.New("missing path")
+		}
+		sink, err = log.NewFileSink(spec.Path, encoder, int64(spec.MaxSize)*megabyte, time.Duration(spec.MaxAge)*time.Hour, spec.MaxBackups)
+	case "syslog":
+		sink = log.NewSyslogSink(tag, encoder)
+	case "journald":
+		sink = log.NewJournaldSink(tag)
+	default:
+		return nil, errors.New("unknown sink type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if spec.Level == "" {
+		return sink, nil
+	}
+	severity, err := log.ParseSeverity(spec.Level)
+	if err != nil {
+		sink.Close()
+		return nil, err
+	}
+	return log.WithLevel(sink, severity), nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	jsonpatch "github.com/evanphx/json-patch"
+	"strings"
+)
+
+// ApplyChangeset applies a remote changeset: a JSON Patch document if it is
+// an array, a JSON Merge Patch otherwise.
+func ApplyChangeset(payload string) error {
+	if strings.HasPrefix(strings.TrimSpace(payload), "[") {
+		return ApplyJSONPatch(payload)
+	}
+	return MergePatch(payload)
+}
+
+// MergePatch applies a RFC 7396 JSON Merge Patch to the remote overrides,
+// which take precedence over every other source. false and 0 are values
+// like any other, and null removes an override, so that the value given by
+// the other sources applies again. The patch is applied entirely, or not at
+// all.
+func MergePatch(payload string) error {
+	object := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &object); err != nil {
+		return errors.New("invalid merge patch: " + err.Error())
+	}
+	remote, err := patchRemote([]byte(payload))
+	if err != nil {
+		return err
+	}
+	return setLayer(SourceRemote, remote)
+}
+
+// ApplyJSONPatch applies a RFC 6902 JSON Patch to the effective
+// configuration, and stores the changes as remote overrides. Paths follow
+// the JSON layout of the configuration, for example /mqtt/port or
+// /log/sinks/-. The patch is applied entirely, or not at all.
+func ApplyJSONPatch(payload string) error {
+	patch, err := jsonpatch.DecodePatch([]byte(payload))
+	if err != nil {
+		return errors.New("invalid json patch: " + err.Error())
+	}
+	loaded := loadedLayers()
+	current, _ := mergeLayers(loaded)
+	original, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	patched, err := patch.Apply(original)
+	if err != nil {
+		return errors.New("could not apply json patch: " + err.Error())
+	}
+	changes, err := jsonpatch.CreateMergePatch(original, patched)
+	if err != nil {
+		return errors.New("could not apply json patch: " + err.Error())
+	}
+	remote, err := patchRemote(changes)
+	if err != nil {
+		return err
+	}
+	candidate := map[string]tree{}
+	for name, layer := range loaded {
+		candidate[name] = layer
+	}
+	candidate[SourceRemote] = remote
+	merged, _ := mergeLayers(candidate)
+	result, _ := json.Marshal(merged)
+	if !jsonpatch.Equal(result, patched) {
+		return errors.New("could not apply json patch: only remote overrides can be removed")
+	}
+	return setLayer(SourceRemote, remote)
+}
+
+// patchRemote returns the remote overrides, with a merge patch applied.
+func patchRemote(patch []byte) (tree, error) {
+	original, err := json.Marshal(copyTree(loadedLayers()[SourceRemote]))
+	if err != nil {
+		return nil, err
+	}
+	patched, err := jsonpatch.MergePatch(original, patch)
+	if err != nil {
+		return nil, errors.New("could not apply merge patch: " + err.Error())
+	}
+	remote := tree{}
+	if err := json.Unmarshal(patched, &remote); err != nil {
+		return nil, errors.New("could not apply merge patch: " + err.Error())
+	}
+	return remote, nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import "testing"
+
+func TestMergePatch(t *testing.T) {
+	LoadDefaults()
+	if err := LoadEnv([]string{"WEATHERCONTROLLER_MQTT_HOST=broker.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergePatch(`{"mqtt": {"ssl": true, "host": "remote.example.org"}}`); err != nil || !Ssl() {
+		t.Fatal("MergePatch should set values: got ", err)
+	}
+	if err := MergePatch(`{"mqtt": {"ssl": false}}`); err != nil || Ssl() {
+		t.Error("MergePatch should set false values: got ", Ssl(), " ", err)
+	}
+	if err := MergePatch(`{"mqtt": {"host": null}}`); err != nil || Host() != "broker.example.org" || Source("mqtt.host") != SourceEnv {
+		t.Error("MergePatch should remove overrides set to null: got ", Host(), " ", err)
+	}
+	if err := MergePatch(`[]`); err == nil {
+		t.Error("MergePatch should reject documents which are not objects")
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	LoadDefaults()
+	err := ApplyChangeset(`[
+		{"op": "test", "path": "/mqtt/port", "value": 1883},
+		{"op": "replace", "path": "/mqtt/port", "value": 8883},
+		{"op": "add", "path": "/log/sinks/-", "value": {"type": "syslog", "level": "warn"}}
+	]`)
+	if err != nil {
+		t.Fatal("ApplyChangeset should apply JSON Patch documents: got ", err)
+	}
+	if Port() != 8883 || len(store.Log.Sinks) != 2 || store.Log.Sinks[1].Type != "syslog" || Source("log.sinks") != SourceRemote {
+		t.Error("ApplyJSONPatch should apply each operation: got ", Port(), " ", store.Log.Sinks)
+	}
+	if err := ApplyJSONPatch(`[{"op": "test", "path": "/mqtt/port", "value": 1883}, {"op": "replace", "path": "/mqtt/host", "value": "other"}]`); err == nil || Host() != "172.20.0.100" {
+		t.Error("ApplyJSONPatch should not apply anything when an operation fails: got ", Host(), " ", err)
+	}
+	if err := ApplyJSONPatch(`[{"op": "remove", "path": "/homie/name"}]`); err == nil {
+		t.Error("ApplyJSONPatch should not remove values set by other sources")
+	}
+	if err := ApplyJSONPatch(`[{"op": "replace", "path": "/mqtt/port", "value": 0}]`); err == nil || Port() != 8883 {
+		t.Error("ApplyJSONPatch should validate the result: got ", Port(), " ", err)
+	}
+}
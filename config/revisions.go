@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"strconv"
+	"time"
+)
+
+// Sources of revisions, telling what caused a configuration to be saved.
+const (
+	RevisionMQTT     = "mqtt"
+	RevisionCLI      = "cli"
+	RevisionStartup  = "startup"
+	RevisionRollback = "rollback"
+	RevisionReload   = "reload"
+)
+
+const revisionsBucket = "revisions"
+
+// Revision is a saved configuration. Config is the effective configuration,
+// and Diff the JSON Merge Patch from the previous revision, both with
+// secrets redacted.
+type Revision struct {
+	Seq       uint64          `json:"seq"`
+	Timestamp time.Time       `json:"timestamp"`
+	Source    string          `json:"source"`
+	Diff      json.RawMessage `json:"diff,omitempty"`
+	Config    json.RawMessage `json:"config,omitempty"`
+}
+
+// revisionRecord is a revision as stored in the database, along with the
+// remote overrides needed to roll back to it, secrets encrypted.
+type revisionRecord struct {
+	Revision
+	Schema    int  `json:"schema"`
+	Overrides tree `json:"overrides"`
+}
+
+func revisionKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// saveRevision records the running configuration as a new revision, unless
+// it did not change since the previous one, and applies the retention.
+func saveRevision(source string) error {
+	keys, err := db.keys(revisionsBucket)
+	if err != nil {
+		return err
+	}
+	current, _ := json.Marshal(sanitized())
+	record := revisionRecord{
+		Revision:  Revision{Seq: 1, Timestamp: time.Now(), Source: source, Config: current, Diff: current},
+		Schema:    SchemaVersion,
+		Overrides: copyTree(loadedLayers()[SourceRemote]),
+	}
+	if len(keys) > 0 {
+		previous, err := loadRevision(keys[len(keys)-1])
+		if err != nil {
+			return err
+		}
+		diff, err := jsonpatch.CreateMergePatch(previous.Config, current)
+		if err != nil {
+			return err
+		}
+		if string(diff) == "{}" && jsonpatch.Equal(mustMarshal(previous.Overrides), mustMarshal(record.Overrides)) {
+			return nil
+		}
+		record.Seq, record.Diff = previous.Seq+1, diff
+	}
+	stored := record
+	if stored.Overrides, err = encryptSecrets(record.Overrides); err != nil {
+		return errors.New("could not encrypt secrets: " + err.Error())
+	}
+	buf, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := db.put(revisionsBucket, revisionKey(record.Seq), buf); err != nil {
+		return err
+	}
+	logger.Info("saved configuration revision ", record.Seq, " from ", source)
+	retention := loaded().Revisions.Retention
+	if retention > 0 && len(keys)+1 > retention {
+		for _, key := range keys[:len(keys)+1-retention] {
+			if err := db.delete(revisionsBucket, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mustMarshal(value interface{}) []byte {
+	buf, _ := json.Marshal(value)
+	return buf
+}
+
+func loadRevision(key string) (revisionRecord, error) {
+	record := revisionRecord{}
+	buf, err := db.get(revisionsBucket, key)
+	if err != nil {
+		return record, err
+	}
+	if len(buf) == 0 {
+		return record, errors.New("revision not found")
+	}
+	if err := json.Unmarshal(buf, &record); err != nil {
+		return record, err
+	}
+	record.Overrides, err = decryptSecrets(record.Overrides)
+	return record, err
+}
+
+// Revisions lists the saved revisions, oldest first, without their
+// configuration.
+func Revisions() ([]Revision, error) {
+	if db == nil {
+		return nil, errors.New("configuration database is not open")
+	}
+	keys, err := db.keys(revisionsBucket)
+	if err != nil {
+		return nil, err
+	}
+	revisions := []Revision{}
+	for _, key := range keys {
+		record, err := loadRevision(key)
+		if err != nil {
+			return nil, err
+		}
+		record.Config = nil
+		revisions = append(revisions, record.Revision)
+	}
+	return revisions, nil
+}
+
+// GetRevision returns a saved revision.
+func GetRevision(seq uint64) (Revision, error) {
+	if db == nil {
+		return Revision{}, errors.New("configuration database is not open")
+	}
+	record, err := loadRevision(revisionKey(seq))
+	if err != nil {
+		return Revision{}, errors.New("revision " + strconv.FormatUint(seq, 10) + ": " + err.Error())
+	}
+	return record.Revision, nil
+}
+
+// LoadRevision replaces the remote overrides with those of a saved revision.
+// The running configuration changes like with MergePatch, and is recorded as
+// a new revision by Save.
+func LoadRevision(seq uint64) error {
+	if db == nil {
+		return errors.New("configuration database is not open")
+	}
+	record, err := loadRevision(revisionKey(seq))
+	if err != nil {
+		return errors.New("revision " + strconv.FormatUint(seq, 10) + ": " + err.Error())
+	}
+	overrides, err := migrate(record.Overrides, record.Schema)
+	if err != nil {
+		return errors.New("revision " + strconv.FormatUint(seq, 10) + ": " + err.Error())
+	}
+	return setLayer(SourceRemote, overrides)
+}
@@ -0,0 +1,45 @@
+package config
+
+import "testing"
+
+func TestRevisions(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadDefaults()
+	if err := MergePatch(`{"revisions": {"retention": 3}}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []string{"1884", "1885", "1885", "1886"} {
+		if err := MergePatch(`{"mqtt": {"port": ` + port + `}}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := Save(RevisionMQTT); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revisions, err := Revisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[0].Seq != 1 || revisions[2].Seq != 3 {
+		t.Fatal("Save should skip unchanged revisions and apply the retention: got ", revisions)
+	}
+	if string(revisions[2].Diff) != `{"mqtt":{"port":1886}}` || revisions[2].Source != RevisionMQTT {
+		t.Error("revisions should record their diff and source: got ", string(revisions[2].Diff), " from ", revisions[2].Source)
+	}
+	if err := LoadRevision(2); err != nil || Port() != 1885 {
+		t.Fatal("LoadRevision should restore the overrides of a revision: got ", Port(), " ", err)
+	}
+	if err := Save(RevisionRollback); err != nil {
+		t.Fatal(err)
+	}
+	revision, err := GetRevision(4)
+	if err != nil || revision.Source != RevisionRollback || string(revision.Diff) != `{"mqtt":{"port":1885}}` {
+		t.Error("a rollback should be recorded as a new revision: got ", revision, err)
+	}
+	if _, err := GetRevision(1); err == nil {
+		t.Error("GetRevision should fail for revisions removed by the retention")
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// SchemaVersion is the version of Format. Increase it, and register a
+// migration upgrading the previous version, when a change to Format would
+// break the persisted configurations, such as renaming a setting.
+const SchemaVersion = 1
+
+const backupsBucket = "backups"
+
+// Migration upgrades persisted remote overrides from the previous schema
+// version.
+type Migration func(overrides map[string]interface{}) error
+
+// migrations are keyed by the version they upgrade to.
+var migrations = map[int]Migration{}
+
+// persistedSchema is the schema version of the database. Nothing is saved
+// when it is newer than SchemaVersion, so that the configuration of a newer
+// version survives a downgrade.
+var persistedSchema = SchemaVersion
+
+// RegisterMigration registers the migration upgrading persisted
+// configurations to version.
+func RegisterMigration(version int, migration Migration) {
+	migrations[version] = migration
+}
+
+func init() {
+	RegisterMigration(1, dropDefaults)
+}
+
+// v0Defaults are the defaults saved by version 0 along with the changed
+// settings. They are frozen, so that the migration does not depend on the
+// defaults of the running version.
+const v0Defaults = `{
+  "mqtt": {"host": "172.20.0.100", "port": 1883, "ssl_config": {"ca": "", "client_cert": "", "privkey": ""}},
+  "homie": {"name": "weatherController", "prefix": "devices/"},
+  "log": {
+    "level": "debug", "format": "text", "overflow": "drop_below", "overflow_level": "warn",
+    "history": 500, "dedup_window": 10, "sinks": [{"type": "stdout"}],
+    "remote": {"level": "warn", "rate": 5}
+  }
+}`
+
+// dropDefaults upgrades configurations saved before the configuration was
+// layered. They held the whole configuration instead of the remote
+// overrides only, and would hide the values of the configuration file, the
+// environment and the flags behind the defaults. Values differing from the
+// version 0 defaults, even empty or false, were set on purpose and are kept.
+func dropDefaults(overrides map[string]interface{}) error {
+	defaults := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(v0Defaults), &defaults); err != nil {
+		return err
+	}
+	var prune func(object map[string]interface{}, defaults map[string]interface{})
+	prune = func(object map[string]interface{}, defaults map[string]interface{}) {
+		for key, value := range object {
+			child, isObject := value.(map[string]interface{})
+			defaultChild, defaultIsObject := defaults[key].(map[string]interface{})
+			if isObject && defaultIsObject {
+				prune(child, defaultChild)
+				if len(child) == 0 {
+					delete(object, key)
+				}
+			} else if defaultValue, found := defaults[key]; found && reflect.DeepEqual(value, defaultValue) {
+				delete(object, key)
+			}
+		}
+	}
+	prune(overrides, defaults)
+	return nil
+}
+
+// migrate upgrades overrides from a schema version to SchemaVersion.
+func migrate(overrides tree, from int) (tree, error) {
+	if from > SchemaVersion {
+		return nil, errors.New("configuration schema version " + strconv.Itoa(from) + " is newer than the supported version " + strconv.Itoa(SchemaVersion))
+	}
+	migrated := copyTree(overrides)
+	for version := from + 1; version <= SchemaVersion; version++ {
+		migration, found := migrations[version]
+		if !found {
+			return nil, errors.New("no migration to configuration schema version " + strconv.Itoa(version))
+		}
+		if err := migration(migrated); err != nil {
+			return nil, errors.New("could not migrate configuration to schema version " + strconv.Itoa(version) + ": " + err.Error())
+		}
+	}
+	return migrated, nil
+}
+
+// readSchema returns the schema version of the database. Databases without
+// a version were written before versioning, by version 0.
+func readSchema() (int, error) {
+	buf, err := db.get("config", "schema")
+	if err != nil || len(buf) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(string(buf))
+}
+
+// migratePersisted upgrades the persisted overrides to SchemaVersion, after
+// a backup of the original in the backups bucket.
+func migratePersisted(buf []byte) (tree, error) {
+	schema, err := readSchema()
+	if err != nil {
+		return nil, errors.New("invalid configuration schema version: " + err.Error())
+	}
+	persistedSchema = schema
+	persisted := tree{}
+	if err := json.Unmarshal(buf, &persisted); err != nil {
+		return nil, err
+	}
+	overrides, err := decryptSecrets(persisted)
+	if err != nil {
+		return nil, err
+	}
+	if schema == SchemaVersion {
+		return overrides, nil
+	}
+	migrated, err := migrate(overrides, schema)
+	if err != nil {
+		return nil, err
+	}
+	// configurations written before secrets were encrypted hold them in
+	// plain text, which the backup must not keep
+	backupBuf, err := marshalEncrypted(persisted)
+	if err != nil {
+		return nil, err
+	}
+	backup := "store-schema-" + strconv.Itoa(schema) + "-" + time.Now().UTC().Format("20060102T150405Z")
+	if err := db.put(backupsBucket, backup, backupBuf); err != nil {
+		return nil, errors.New("could not back up configuration before migration: " + err.Error())
+	}
+	logger.Info("backed up configuration to ", backupsBucket, "/", backup)
+	migratedBuf, err := marshalEncrypted(migrated)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.put("config", "store", migratedBuf); err != nil {
+		return nil, err
+	}
+	if err := writeSchema(); err != nil {
+		return nil, err
+	}
+	logger.Info("migrated configuration from schema version ", schema, " to ", SchemaVersion)
+	return migrated, nil
+}
+
+func marshalEncrypted(overrides tree) ([]byte, error) {
+	encrypted, err := encryptSecrets(overrides)
+	if err != nil {
+		return nil, errors.New("could not encrypt secrets: " + err.Error())
+	}
+	return json.Marshal(encrypted)
+}
+
+func writeSchema() error {
+	if err := db.put("config", "schema", []byte(strconv.Itoa(SchemaVersion))); err != nil {
+		return err
+	}
+	persistedSchema = SchemaVersion
+	return nil
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMigration(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadDefaults()
+	if err := LoadEnv([]string{"WEATHERCONTROLLER_MQTT_HOST=broker.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	// written by version 0, holding the whole configuration
+	original := `{"mqtt": {"host": "172.20.0.100", "port": 8883, "ssl_config": {"ca": "", "client_cert": "", "privkey": ""}}, "homie": {"name": "shed", "prefix": "devices/"}, "security": {"hmac_secret": "s3cret"}}`
+	if err := db.put("config", "store", []byte(original)); err != nil {
+		t.Fatal(err)
+	}
+	LoadPersisted()
+	if Host() != "broker.example.org" || Port() != 8883 || HomieName() != "shed" {
+		t.Error("LoadPersisted should migrate the persisted configuration: got ", Host(), " ", Port(), " ", HomieName())
+	}
+	if schema, _ := readSchema(); schema != SchemaVersion {
+		t.Error("LoadPersisted should save the migrated schema version: got ", schema)
+	}
+	keys, _ := db.keys(backupsBucket)
+	if len(keys) != 1 {
+		t.Fatal("LoadPersisted should back up the configuration before migrating: got ", keys)
+	}
+	backup, _ := db.get(backupsBucket, keys[0])
+	if strings.Contains(string(backup), "s3cret") {
+		t.Error("the backup should not hold secrets in plain text: got ", string(backup))
+	}
+	backupTree, expected := tree{}, tree{}
+	json.Unmarshal(backup, &backupTree)
+	json.Unmarshal([]byte(original), &expected)
+	if decrypted, _ := decryptSecrets(backupTree); !reflect.DeepEqual(decrypted, expected) {
+		t.Error("the backup should hold the original configuration: got ", decrypted)
+	}
+	db.put("config", "schema", []byte(strconv.Itoa(SchemaVersion+1)))
+	LoadPersisted()
+	if err := Save(RevisionCLI); err == nil {
+		t.Error("Save should not overwrite a configuration written by a newer version")
+	}
+}
+
+func TestDropDefaults(t *testing.T) {
+	overrides := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"homie": {"name": "weatherController", "prefix": ""}, "mqtt": {"host": "10.0.0.1", "port": 1883, "ssl_config": {"ca": ""}}, "security": {"max_skew": 0}}`), &overrides)
+	if err := dropDefaults(overrides); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"homie": {"prefix": ""}, "mqtt": {"host": "10.0.0.1"}, "security": {"max_skew": 0}}`), &expected)
+	if !reflect.DeepEqual(overrides, expected) {
+		t.Error("dropDefaults should only drop the version 0 defaults, and keep explicit empty values: got ", overrides)
+	}
+}
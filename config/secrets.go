@@ -0,0 +1,237 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	// SecretKeyEnv gives the base64 encoded AES key encrypting the secret
+	// settings in the configuration database.
+	SecretKeyEnv = "WEATHERCONTROLLER_SECRET_KEY"
+	// SecretKeyFileEnv gives the path of a file holding the key. Without
+	// SecretKeyEnv nor SecretKeyFileEnv, the key is kept in the data
+	// directory, and generated the first time.
+	SecretKeyFileEnv = "WEATHERCONTROLLER_SECRET_KEY_FILE"
+	secretKeyName    = "secret.key"
+	secretKeySize    = 32
+	encryptedPrefix  = "encrypted:"
+)
+
+var secretKey []byte
+
+// loadSecretKey loads the key encrypting the secret settings. An empty
+// dataDir, used by the in-memory mode, gets a random key unless one is given
+// by the environment.
+func loadSecretKey(dataDir string) error {
+	if encoded := os.Getenv(SecretKeyEnv); encoded != "" {
+		key, err := decodeSecretKey(encoded)
+		if err != nil {
+			return errors.New("invalid " + SecretKeyEnv + ": " + err.Error())
+		}
+		secretKey = key
+		return nil
+	}
+	path := os.Getenv(SecretKeyFileEnv)
+	if path == "" && dataDir == "" {
+		secretKey = make([]byte, secretKeySize)
+		_, err := rand.Read(secretKey)
+		return err
+	}
+	if path == "" {
+		path = filepath.Join(dataDir, secretKeyName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return generateSecretKey(path)
+		}
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("could not read secret key: " + err.Error())
+	}
+	key, err := decodeSecretKey(string(buf))
+	if err != nil {
+		return errors.New("invalid secret key " + path + ": " + err.Error())
+	}
+	secretKey = key
+	return nil
+}
+
+func decodeSecretKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != secretKeySize {
+		return nil, errors.New("the key must be 32 base64 encoded bytes")
+	}
+	return key, nil
+}
+
+func generateSecretKey(path string) error {
+	key := make([]byte, secretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return errors.New("could not write secret key: " + err.Error())
+	}
+	logger.Info("generated secret key ", path)
+	secretKey = key
+	return nil
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	if secretKey == nil {
+		return nil, errors.New("no secret key loaded")
+	}
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(plaintext string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret decrypts a value encrypted by encryptSecret. Other values,
+// saved before secrets were encrypted, are returned as is.
+func decryptSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("could not decrypt secret: wrong secret key?")
+	}
+	return string(plaintext), nil
+}
+
+// secretPaths lists the settings tagged secret, such as
+// "security.hmac_secret".
+func secretPaths() map[string]bool {
+	paths := map[string]bool{}
+	for _, s := range settings(reflect.TypeOf(Format{}), "") {
+		if s.secret {
+			paths[s.path] = true
+		}
+	}
+	return paths
+}
+
+// transformSecrets replaces the secret strings of value, set at path, by the
+// result of transform.
+func transformSecrets(path string, value interface{}, secrets map[string]bool, transform func(string) (string, error)) (interface{}, error) {
+	if secrets[path] {
+		if text, ok := value.(string); ok && text != "" {
+			return transform(text)
+		}
+		return value, nil
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value, nil
+	}
+	for key, child := range object {
+		childPath := key
+		if path != "" {
+			childPath = path + "." + key
+		}
+		transformed, err := transformSecrets(childPath, child, secrets, transform)
+		if err != nil {
+			return nil, errors.New(childPath + ": " + err.Error())
+		}
+		object[key] = transformed
+	}
+	return object, nil
+}
+
+// encryptSecrets returns a copy of overrides with its secrets encrypted, to
+// be persisted.
+func encryptSecrets(overrides tree) (tree, error) {
+	encrypted, err := transformSecrets("", map[string]interface{}(copyTree(overrides)), secretPaths(), encryptSecret)
+	if err != nil {
+		return nil, err
+	}
+	return tree(encrypted.(map[string]interface{})), nil
+}
+
+// decryptSecrets returns a copy of persisted overrides with its secrets
+// decrypted.
+func decryptSecrets(overrides tree) (tree, error) {
+	decrypted, err := transformSecrets("", map[string]interface{}(copyTree(overrides)), secretPaths(), decryptSecret)
+	if err != nil {
+		return nil, err
+	}
+	return tree(decrypted.(map[string]interface{})), nil
+}
+
+func redactSecret(string) (string, error) {
+	return redacted, nil
+}
+
+// redactSecrets replaces the secret settings of a configuration.
+func redactSecrets(value reflect.Value) {
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Field(idx)
+		if field.Kind() == reflect.Struct {
+			redactSecrets(field)
+		} else if value.Type().Field(idx).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(redacted)
+		}
+	}
+}
+
+// Redact returns a changeset, either a JSON Merge Patch or a JSON Patch, with
+// the values of secret settings redacted so that it can be logged.
+func Redact(changeset string) string {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(changeset), &decoded); err != nil {
+		return redacted
+	}
+	secrets := secretPaths()
+	if operations, ok := decoded.([]interface{}); ok {
+		for _, item := range operations {
+			operation, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			path, _ := operation["path"].(string)
+			path = strings.Replace(strings.TrimPrefix(path, "/"), "/", ".", -1)
+			if value, found := operation["value"]; found {
+				operation["value"], _ = transformSecrets(path, value, secrets, redactSecret)
+			}
+		}
+	} else {
+		decoded, _ = transformSecrets("", decoded, secrets, redactSecret)
+	}
+	buf, _ := json.Marshal(decoded)
+	return string(buf)
+}
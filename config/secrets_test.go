@@ -0,0 +1,60 @@
+package config
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSecrets(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadDefaults()
+	if err := MergePatch(`{"security": {"hmac_secret": "s3cret"}, "radio": {"encryption_key": "0123456789abcdef"}}`); err != nil {
+		t.Fatal(err)
+	}
+	for name, output := range map[string]string{"Dump": Dump(), "Sanitized": Sanitized(), "Describe": Describe()} {
+		if strings.Contains(output, "s3cret") || strings.Contains(output, "0123456789abcdef") {
+			t.Error(name, " should redact secrets: got ", output)
+		}
+	}
+	if err := Save(RevisionCLI); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := db.get("config", "store")
+	if strings.Contains(string(buf), "s3cret") || !strings.Contains(string(buf), encryptedPrefix) {
+		t.Error("Save should encrypt secrets: got ", string(buf))
+	}
+	LoadDefaults()
+	LoadPersisted()
+	if store.Security.HMACSecret != "s3cret" || Radio().EncryptionKey != "0123456789abcdef" {
+		t.Error("LoadPersisted should decrypt secrets: got ", store.Security.HMACSecret, " ", Radio().EncryptionKey)
+	}
+	os.Setenv(SecretKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, secretKeySize)))
+	defer os.Unsetenv(SecretKeyEnv)
+	if err := loadSecretKey(""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptSecrets(tree{"security": map[string]interface{}{"hmac_secret": store.Security.HMACSecret}}); err != nil {
+		t.Error("decryptSecrets should keep plain text values: got ", err)
+	}
+	if _, err := migratePersisted(buf); err == nil {
+		t.Error("secrets should not be decrypted with another key")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	// the part of each changeset that must be kept
+	for changeset, kept := range map[string]string{
+		`{"security": {"hmac_secret": "s3cret", "max_skew": 60}}`:                  `"max_skew":60`,
+		`[{"op": "replace", "path": "/radio/encryption_key", "value": "s3cret"}]`:  `"path":"/radio/encryption_key"`,
+		`[{"op": "add", "path": "/security", "value": {"hmac_secret": "s3cret"}}]`: `"hmac_secret"`,
+	} {
+		if redactedChangeset := Redact(changeset); strings.Contains(redactedChangeset, "s3cret") || !strings.Contains(redactedChangeset, kept) {
+			t.Error("Redact should only redact secrets: got ", redactedChangeset)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/jbonachera/weathercontroller/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDataDir is where the configuration database is kept, unless
+	// another directory is given.
+	DefaultDataDir = "/var/lib/weathercontroller"
+	// DataDirEnv overrides DefaultDataDir.
+	DataDirEnv = "WEATHERCONTROLLER_DATA_DIR"
+	dbName     = "config.db"
+	// InMemory can be given to Open to keep the configuration in memory,
+	// for example in tests.
+	InMemory = ":memory:"
+	// openTimeout bounds the wait for the database lock, held by any other
+	// running process.
+	openTimeout = 5 * time.Second
+)
+
+// backend persists values, by bucket and key.
+type backend interface {
+	get(bucket string, key string) ([]byte, error)
+	put(bucket string, key string, value []byte) error
+	delete(bucket string, key string) error
+	// keys returns the keys of a bucket, sorted.
+	keys(bucket string) ([]string, error)
+	close() error
+}
+
+var db backend = nil
+
+// ErrLocked is returned by Open when another process, such as the running
+// service, holds the configuration database.
+var ErrLocked = errors.New("configuration database is locked by another process: stop the service first")
+
+// DataDir returns the data directory from the environment, or
+// DefaultDataDir.
+func DataDir() string {
+	if dir := os.Getenv(DataDirEnv); dir != "" {
+		return dir
+	}
+	return DefaultDataDir
+}
+
+// DBPath returns the path of the configuration database in dataDir.
+func DBPath(dataDir string) string {
+	return filepath.Join(dataDir, dbName)
+}
+
+// Open opens the configuration database at path, creating it if needed, and
+// loads the secret key. It must be called before LoadPersisted or Save, and
+// closed with Stop. The config package then logs through l, unless nil.
+func Open(path string, l *log.Logger) error {
+	if db != nil {
+		return errors.New("configuration database is already open")
+	}
+	if l != nil {
+		logger = l
+	}
+	if path == InMemory {
+		if err := loadSecretKey(""); err != nil {
+			return err
+		}
+		db = newMemoryBackend()
+		persistedSchema = SchemaVersion
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.New("could not create data directory: " + err.Error())
+	}
+	if err := loadSecretKey(filepath.Dir(path)); err != nil {
+		return err
+	}
+	opened, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		return ErrLocked
+	}
+	if err != nil {
+		return errors.New("could not open configuration database " + path + ": " + err.Error())
+	}
+	db = &boltBackend{db: opened}
+	persistedSchema = SchemaVersion
+	return nil
+}
+
+func Stop() {
+	if db == nil {
+		return
+	}
+	if err := db.close(); err != nil {
+		logger.Error("could not close configuration database: ", err)
+	}
+	db = nil
+}
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func (b *boltBackend) get(bucket string, key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return errors.New("bucket '" + bucket + "' not found")
+		}
+		// values are only valid during the transaction
+		value = append([]byte{}, bkt.Get([]byte(key))...)
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltBackend) put(bucket string, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), value)
+	})
+}
+
+func (b *boltBackend) delete(bucket string, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) keys(bucket string) ([]string, error) {
+	keys := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(key []byte, value []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (b *boltBackend) close() error {
+	return b.db.Close()
+}
+
+type memoryBackend struct {
+	lock    sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryBackend() backend {
+	return &memoryBackend{buckets: map[string]map[string][]byte{}}
+}
+
+func (m *memoryBackend) get(bucket string, key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	bkt, found := m.buckets[bucket]
+	if !found {
+		return nil, errors.New("bucket '" + bucket + "' not found")
+	}
+	return append([]byte{}, bkt[key]...), nil
+}
+
+func (m *memoryBackend) put(bucket string, key string, value []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.buckets[bucket]; !found {
+		m.buckets[bucket] = map[string][]byte{}
+	}
+	m.buckets[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+func (m *memoryBackend) delete(bucket string, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memoryBackend) keys(bucket string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := []string{}
+	for key := range m.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryBackend) close() error {
+	return nil
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sections of the configuration, named after their JSON key, that listeners
+// subscribe to.
+const (
+	SectionMQTT  = "mqtt"
+	SectionHomie = "homie"
+	SectionRadio = "radio"
+	SectionLog   = "log"
+	SectionOTA   = "ota"
+)
+
+// Listener applies a configuration change to a subsystem. previous and
+// current are copies of the whole configuration before and after the
+// change. An error cancels the change.
+type Listener func(previous Format, current Format) error
+
+type subscription struct {
+	sections []string
+	listener Listener
+}
+
+var subscriptions = []subscription{}
+
+// updateLock serializes Update calls, coming from MQTT and from the signal
+// handlers, so that a change cannot restore the checkpoint of another.
+var updateLock sync.Mutex
+
+// Subscribe registers a listener called by Update when one of sections
+// changes, or on every change when no section is given. Listeners are called
+// in the order they subscribed.
+func Subscribe(listener Listener, sections ...string) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	subscriptions = append(subscriptions, subscription{sections: sections, listener: listener})
+}
+
+// changedSections returns the top-level sections differing between two
+// configurations.
+func changedSections(previous Format, current Format) map[string]bool {
+	before, _ := toTree(previous)
+	after, _ := toTree(current)
+	changed := map[string]bool{}
+	for section := range before {
+		if !reflect.DeepEqual(before[section], after[section]) {
+			changed[section] = true
+		}
+	}
+	for section := range after {
+		if _, found := before[section]; !found {
+			changed[section] = true
+		}
+	}
+	return changed
+}
+
+func (s subscription) concerned(changed map[string]bool) bool {
+	if len(s.sections) == 0 {
+		return len(changed) > 0
+	}
+	for _, section := range s.sections {
+		if changed[section] {
+			return true
+		}
+	}
+	return false
+}
+
+// Update changes the configuration, notifies the listeners of the changed
+// sections, and saves the result as a revision caused by source. If change
+// fails or gives an invalid configuration, or if a listener fails, the
+// previous configuration is restored, the listeners already notified are
+// called again to revert the change, and the error is returned. An error is also returned when the change is applied
+// but could not be saved.
+func Update(source string, change func() error) error {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+	checkpoint := Checkpoint()
+	if err := change(); err != nil {
+		return err
+	}
+	if err := ValidateLoaded(); err != nil {
+		Restore(checkpoint)
+		return err
+	}
+	previous, current := checkpoint.store, Current()
+	changed := changedSections(previous, current)
+	if len(changed) == 0 {
+		logger.Info("configuration unchanged")
+	} else {
+		sections := make([]string, 0, len(changed))
+		for section := range changed {
+			sections = append(sections, section)
+		}
+		sort.Strings(sections)
+		logger.Info("configuration sections changed: ", strings.Join(sections, ", "))
+	}
+	logger.Debug("new config: ", Sanitized())
+	storeLock.RLock()
+	listeners := subscriptions
+	storeLock.RUnlock()
+	notified := []subscription{}
+	for _, s := range listeners {
+		if !s.concerned(changed) {
+			continue
+		}
+		if err := s.listener(clone(previous), clone(current)); err != nil {
+			Restore(checkpoint)
+			for idx := len(notified) - 1; idx >= 0; idx-- {
+				if revertErr := notified[idx].listener(clone(current), clone(previous)); revertErr != nil {
+					logger.Error("could not revert configuration change: ", revertErr)
+				}
+			}
+			return err
+		}
+		notified = append(notified, s)
+	}
+	if err := Save(source); err != nil {
+		return errors.New("configuration applied, but will be lost on restart: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadDefaults()
+	defer func() { subscriptions = []subscription{} }()
+	calls := []string{}
+	Subscribe(func(previous Format, current Format) error {
+		calls = append(calls, "homie "+previous.Homie.Name+" -> "+current.Homie.Name)
+		return nil
+	}, SectionHomie)
+	Subscribe(func(previous Format, current Format) error {
+		calls = append(calls, "mqtt")
+		if current.Mqtt.Host == "broken" {
+			return errors.New("could not connect")
+		}
+		return nil
+	}, SectionMQTT)
+	if err := Update(RevisionCLI, func() error { return MergePatch(`{"homie": {"name": "shed"}}`) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != "homie weatherController -> shed" {
+		t.Error("Update should only notify the listeners of the changed sections: got ", calls)
+	}
+	calls = []string{}
+	err := Update(RevisionCLI, func() error { return MergePatch(`{"homie": {"name": "barn"}, "mqtt": {"host": "broken"}}`) })
+	if err == nil {
+		t.Error("Update should fail when a listener fails")
+	}
+	if HomieName() != "shed" || Host() != "172.20.0.100" {
+		t.Error("Update should restore the previous configuration when a listener fails: got ", HomieName(), " ", Host())
+	}
+	if len(calls) != 3 || calls[2] != "homie barn -> shed" {
+		t.Error("Update should revert the listeners already notified: got ", calls)
+	}
+}
+
+func TestUpdateSaveError(t *testing.T) {
+	LoadDefaults()
+	if err := Update(RevisionCLI, func() error { return MergePatch(`{"homie": {"name": "shed"}}`) }); err == nil {
+		t.Error("Update should report changes that could not be saved")
+	}
+}
+
+func TestUpdateReload(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(path, []byte("mqtt:\n  host: broker.example.org\nradio:\n  frequency: \"433\"\n"), 0600)
+	LoadDefaults()
+	if err := LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { subscriptions = []subscription{} }()
+	notified := map[string]int{}
+	for _, section := range []string{SectionMQTT, SectionRadio} {
+		section := section
+		Subscribe(func(previous Format, current Format) error {
+			notified[section]++
+			return nil
+		}, section)
+	}
+	reload := func() error { return LoadFile(path) }
+	ioutil.WriteFile(path, []byte("mqtt:\n  host: broker.example.org\nradio:\n  frequency: \"868\"\n"), 0600)
+	if err := Update(RevisionReload, reload); err != nil {
+		t.Fatal(err)
+	}
+	if Radio().Frequency != "868" || notified[SectionRadio] != 1 || notified[SectionMQTT] != 0 {
+		t.Error("reloading the configuration file should only notify the changed sections: got ", notified)
+	}
+	ioutil.WriteFile(path, []byte("radio:\n  frequency: \"2400\"\n"), 0600)
+	if err := Update(RevisionReload, reload); err == nil {
+		t.Error("reloading an invalid configuration file should fail")
+	}
+	if Radio().Frequency != "868" || Host() != "broker.example.org" || notified[SectionRadio] != 1 {
+		t.Error("reloading an invalid configuration file should keep the running configuration: got ", Radio().Frequency, " ", Host())
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	if err := Open(InMemory, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+	LoadDefaults()
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				Host()
+				Source("mqtt.port")
+				Sanitized()
+			}
+		}
+	}()
+	renamed := make(chan error)
+	go func() {
+		for idx := 0; idx < 20; idx++ {
+			if err := Update(RevisionMQTT, func() error { return MergePatch(`{"homie": {"name": "node` + strconv.Itoa(idx) + `"}}`) }); err != nil {
+				renamed <- err
+				return
+			}
+		}
+		renamed <- nil
+	}()
+	for port := 1000; port < 1020; port++ {
+		if err := Update(RevisionCLI, func() error { return MergePatch(`{"mqtt": {"port": ` + strconv.Itoa(port) + `}}`) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-renamed; err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	if Port() != 1019 || HomieName() != "node19" {
+		t.Error("concurrent calls to Update should apply every change: got ", Port(), " ", HomieName())
+	}
+}
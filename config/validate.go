@@ -0,0 +1,218 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jbonachera/weathercontroller/log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FieldError reports an invalid setting, such as "mqtt.port".
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (err FieldError) Error() string {
+	return err.Path + ": " + err.Message
+}
+
+// ValidationError lists the invalid settings of a configuration.
+type ValidationError []FieldError
+
+func (err ValidationError) Error() string {
+	messages := make([]string, len(err))
+	for idx, field := range err {
+		messages[idx] = field.Error()
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// Fields returns the error messages, keyed by setting path.
+func (err ValidationError) Fields() map[string]string {
+	fields := map[string]string{}
+	for _, field := range err {
+		fields[field.Path] = field.Message
+	}
+	return fields
+}
+
+type validator struct {
+	errors ValidationError
+}
+
+func (v *validator) fail(path string, message string) {
+	v.errors = append(v.errors, FieldError{Path: path, Message: message})
+}
+
+func (v *validator) check(ok bool, path string, message string) {
+	if !ok {
+		v.fail(path, message)
+	}
+}
+
+func (v *validator) severity(path string, name string) {
+	if _, err := log.ParseSeverity(name); err != nil {
+		v.fail(path, err.Error())
+	}
+}
+
+func (v *validator) encoder(path string, name string) {
+	if _, err := log.ParseEncoder(name); err != nil {
+		v.fail(path, err.Error())
+	}
+}
+
+func (v *validator) publicKey(path string, encoded string) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		v.fail(path, "must be a base64 encoded ed25519 public key")
+	}
+}
+
+// Validate checks a configuration, and returns a ValidationError listing
+// every invalid setting.
+func Validate(candidate Format) error {
+	v := &validator{}
+	validateMQTT(v, candidate.Mqtt)
+	v.check(candidate.Homie.Name != "", "homie.name", "is required")
+	v.check(!strings.ContainsAny(candidate.Homie.Name, "/+#"), "homie.name", "must not contain '/', '+' or '#'")
+	v.check(!strings.ContainsAny(candidate.Homie.Prefix, "+#"), "homie.prefix", "must not contain '+' or '#'")
+	validateRadio(v, candidate.Radio)
+	validateSecurity(v, candidate.Security)
+	validateLog(v, candidate.Log)
+	v.check(candidate.Revisions.Retention >= 0, "revisions.retention", "must not be negative")
+	if candidate.Ota.PublicKey != "" {
+		v.publicKey("ota.public_key", candidate.Ota.PublicKey)
+	}
+	if len(v.errors) > 0 {
+		sort.SliceStable(v.errors, func(i, j int) bool { return v.errors[i].Path < v.errors[j].Path })
+		return v.errors
+	}
+	return nil
+}
+
+func validateMQTT(v *validator, mqtt MQTTFormat) {
+	v.check(mqtt.Host != "", "mqtt.host", "is required")
+	v.check(mqtt.Port > 0 && mqtt.Port < 65536, "mqtt.port", "must be between 1 and 65535")
+	v.check(!strings.ContainsAny(mqtt.Prefix, "+#"), "mqtt.prefix", "must not contain '+' or '#'")
+	// the TLS configuration is only used when a private key is given. Its
+	// files are checked by the MQTT client when connecting.
+	if mqtt.Ssl_Config.Privkey != "" {
+		v.check(mqtt.Ssl_Config.ClientCert != "", "mqtt.ssl_config.client_cert", "is required by the private key")
+		v.check(mqtt.Ssl_Config.CA != "", "mqtt.ssl_config.ca", "is required by the private key")
+	}
+}
+
+// radioBands are the frequencies supported by RFM69 modules, in MHz.
+var radioBands = []string{"315", "433", "868", "915"}
+
+func validateRadio(v *validator, radio RadioFormat) {
+	v.check(radio.NetworkID >= 0 && radio.NetworkID < 256, "radio.network_id", "must be between 0 and 255")
+	// 255 is the broadcast address
+	v.check(radio.ClientID >= 0 && radio.ClientID < 255, "radio.client_id", "must be between 0 and 254")
+	supported := false
+	for _, band := range radioBands {
+		supported = supported || radio.Frequency == band
+	}
+	v.check(supported, "radio.frequency", "must be one of "+strings.Join(radioBands, ", "))
+	v.check(len(radio.EncryptionKey) == 16, "radio.encryption_key", "must be 16 bytes long")
+}
+
+func validateSecurity(v *validator, security SecurityFormat) {
+	switch security.Signature {
+	case SignatureNone:
+	case SignatureHMAC:
+		v.check(security.HMACSecret != "", "security.hmac_secret", "is required by hmac signatures")
+	case SignatureEd25519:
+		v.publicKey("security.public_key", security.PublicKey)
+	default:
+		v.fail("security.signature", "must be empty, "+SignatureHMAC+" or "+SignatureEd25519)
+	}
+	v.check(security.MaxSkew >= 0, "security.max_skew", "must not be negative")
+}
+
+func validateLog(v *validator, format LogFormat) {
+	v.severity("log.level", format.Level)
+	for name, level := range format.Levels {
+		v.severity("log.levels."+name, level)
+	}
+	v.encoder("log.format", format.Format)
+	if _, err := log.ParseOverflowPolicy(format.Overflow, format.OverflowLevel); err != nil {
+		v.fail("log.overflow", err.Error())
+	}
+	v.check(format.History >= 0, "log.history", "must not be negative")
+	v.check(format.DedupWindow >= 0, "log.dedup_window", "must not be negative")
+	for name, rate := range format.RateLimits {
+		v.check(rate >= 0, "log.rate_limits."+name, "must not be negative")
+	}
+	for idx, sink := range format.Sinks {
+		path := "log.sinks." + strconv.Itoa(idx)
+		switch sink.Type {
+		case "stdout", "syslog", "journald":
+		case "file":
+			v.check(sink.Path != "", path+".path", "is required by file sinks")
+		default:
+			v.fail(path+".type", "must be stdout, file, syslog or journald")
+		}
+		if sink.Level != "" {
+			v.severity(path+".level", sink.Level)
+		}
+		if sink.Format != "" {
+			v.encoder(path+".format", sink.Format)
+		}
+		v.check(sink.MaxSize >= 0, path+".max_size", "must not be negative")
+		v.check(sink.MaxAge >= 0, path+".max_age", "must not be negative")
+		v.check(sink.MaxBackups >= 0, path+".max_backups", "must not be negative")
+	}
+	if format.Remote.Enabled {
+		v.severity("log.remote.level", format.Remote.Level)
+	}
+	v.check(format.Remote.Rate >= 0, "log.remote.rate", "must not be negative")
+}
+
+// unknownSettings reports the keys of merged matching no setting, such as
+// misspelled names.
+func unknownSettings(merged map[string]interface{}) ValidationError {
+	known := map[string]bool{}
+	sections := map[string]bool{}
+	for _, s := range settings(reflect.TypeOf(Format{}), "") {
+		known[s.path] = true
+		parts := strings.Split(s.path, ".")
+		for idx := 1; idx < len(parts); idx++ {
+			sections[strings.Join(parts[:idx], ".")] = true
+		}
+	}
+	invalid := ValidationError{}
+	var walk func(object map[string]interface{}, prefix string)
+	walk = func(object map[string]interface{}, prefix string) {
+		for key, value := range object {
+			path := prefix + key
+			if known[path] {
+				continue
+			}
+			child, isObject := value.(map[string]interface{})
+			if sections[path] && isObject {
+				walk(child, path+".")
+				continue
+			}
+			invalid = append(invalid, FieldError{Path: path, Message: "unknown setting"})
+		}
+	}
+	walk(merged, "")
+	sort.Slice(invalid, func(i, j int) bool { return invalid[i].Path < invalid[j].Path })
+	return invalid
+}
+
+// decodeError converts a decoding error to a ValidationError naming the
+// setting, when possible.
+func decodeError(err error) error {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+		return ValidationError{{Path: typeErr.Field, Message: "must be a " + typeErr.Type.String() + ", got " + typeErr.Value}}
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package config
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	LoadDefaults()
+	if err := Validate(Current()); err != nil {
+		t.Fatal("the defaults should be valid: got ", err)
+	}
+	candidate := Current()
+	candidate.Mqtt.Port = 0
+	candidate.Mqtt.Host = ""
+	candidate.Mqtt.Ssl_Config.Privkey = "/nonexistent/client.key"
+	candidate.Log.Levels = map[string]string{"homie": "verbose"}
+	candidate.Radio.Frequency = "2400"
+	candidate.Radio.EncryptionKey = "short"
+	err := Validate(candidate)
+	invalid, ok := err.(ValidationError)
+	if !ok {
+		t.Fatal("Validate should return a ValidationError: got ", err)
+	}
+	fields := invalid.Fields()
+	for _, path := range []string{"mqtt.port", "mqtt.host", "mqtt.ssl_config.client_cert", "mqtt.ssl_config.ca", "log.levels.homie", "radio.frequency", "radio.encryption_key"} {
+		if _, found := fields[path]; !found {
+			t.Error("Validate should report ", path, ": got ", err)
+		}
+	}
+}
+
+func TestMergeJSONStringValidation(t *testing.T) {
+	LoadDefaults()
+	err := MergeJSONString(`{"mqtt": {"port": 70000, "host": "broker.example.org"}}`)
+	if invalid, ok := err.(ValidationError); !ok || invalid.Fields()["mqtt.port"] == "" {
+		t.Error("MergeJSONString should reject invalid values: got ", err)
+	}
+	if Host() != "172.20.0.100" {
+		t.Error("MergeJSONString should not apply an invalid changeset partially: got ", Host())
+	}
+	err = MergeJSONString(`{"mqtt": {"port": "8883"}}`)
+	if invalid, ok := err.(ValidationError); !ok || invalid.Fields()["mqtt.port"] == "" {
+		t.Error("MergeJSONString should report type errors with the setting path: got ", err)
+	}
+	err = MergeJSONString(`{"mqtt": {"hots": "broker.example.org"}}`)
+	if invalid, ok := err.(ValidationError); !ok || invalid.Fields()["mqtt.hots"] != "unknown setting" {
+		t.Error("MergeJSONString should reject unknown settings: got ", err)
+	}
+}
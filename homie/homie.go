@@ -3,6 +3,7 @@ package homie
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -11,13 +12,19 @@ import (
 	"github.com/jbonachera/weathercontroller/log"
 	"io/ioutil"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-func NewClient(prefix string, server string, port int, mqttPrefix string, ssl bool, ssl_ca string, ssl_cert string, ssl_key string, deviceName string, firmwareName string) Client {
-
+// NewClient creates a homie client. Its messages are logged by logger, or by
+// the "homie" logger when nil.
+func NewClient(prefix string, server string, port int, mqttPrefix string, ssl bool, ssl_ca string, ssl_cert string, ssl_key string, deviceName string, firmwareName string, firmwareVersion string, logger *log.Logger) Client {
+	if logger == nil {
+		logger = log.Named("homie")
+	}
 	return &client{
 		name:            deviceName,
 		prefix:          prefix,
@@ -27,7 +34,10 @@ func NewClient(prefix string, server string, port int, mqttPrefix string, ssl bo
 		ssl:             ssl,
 		ssl_config:      config.TLSFormat{CA: ssl_ca, Privkey: ssl_key, ClientCert: ssl_cert},
 		bootTime:        time.Now(),
+		statsProviders:  map[string]func() map[string]string{},
 		firmwareName:    firmwareName,
+		firmwareVersion: firmwareVersion,
+		logger:          logger,
 		nodes:           map[string]Node{},
 		publishChan:     make(chan stateMessage, 10),
 		subscribeChan:   make(chan subscribeMessage, 10),
@@ -35,56 +45,121 @@ func NewClient(prefix string, server string, port int, mqttPrefix string, ssl bo
 	}
 
 }
-func (homieClient *client) getMQTTOptions() *mqtt.ClientOptions {
+func (homieClient *client) getMQTTOptions() (*mqtt.ClientOptions, error) {
 	o := mqtt.NewClientOptions()
 	o.AddBroker(homieClient.Url())
 	o.SetClientID(homieClient.Id())
 	o.SetWill(homieClient.getDevicePrefix()+"$online", "false", 1, true)
 	o.SetKeepAlive(10 * time.Second)
+	o.SetConnectTimeout(connectTimeout)
 	o.SetOnConnectHandler(homieClient.onConnectHandler)
 	if homieClient.ssl_config.Privkey != "" {
-		log.Debug("building TLS configuration")
+		homieClient.logger.Debug("building TLS configuration")
+		if err := homieClient.checkTLSFiles(); err != nil {
+			return nil, err
+		}
 		cert, err := tls.LoadX509KeyPair(homieClient.ssl_config.ClientCert, homieClient.ssl_config.Privkey)
 
 		if err != nil {
-			log.Fatal(err)
+			// the private key path is a secret, and is left out of the error
+			if pathErr, ok := err.(*os.PathError); ok {
+				err = pathErr.Err
+			}
+			return nil, errors.New("could not load TLS certificate: " + err.Error())
 		} else {
-			log.Debug("loaded TLS certificate and private key from ", homieClient.ssl_config.ClientCert, " and ", homieClient.ssl_config.Privkey)
+			homieClient.logger.Debug("loaded TLS certificate from ", homieClient.ssl_config.ClientCert, " and its private key")
 			caCertPool := x509.NewCertPool()
-			log.Debug("loading CA certificate from ", homieClient.ssl_config.CA)
+			homieClient.logger.Debug("loading CA certificate from ", homieClient.ssl_config.CA)
 			caCert, err := ioutil.ReadFile(homieClient.ssl_config.CA)
 			if err != nil {
-				log.Fatal(err)
+				return nil, errors.New("could not load CA certificate: " + err.Error())
 			}
 			caCertPool.AppendCertsFromPEM(caCert)
 			loadedConfig := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true, RootCAs: caCertPool}
 			o.SetTLSConfig(loadedConfig)
 		}
 	}
-	return o
+	return o, nil
+}
+
+// checkTLSFiles reports the TLS files missing when connecting, as they may
+// be installed after the configuration is written.
+func (homieClient *client) checkTLSFiles() error {
+	files := []struct {
+		setting string
+		path    string
+	}{
+		{"mqtt.ssl_config.privkey", homieClient.ssl_config.Privkey},
+		{"mqtt.ssl_config.client_cert", homieClient.ssl_config.ClientCert},
+		{"mqtt.ssl_config.ca", homieClient.ssl_config.CA},
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file.path); err != nil {
+			return errors.New("could not load TLS configuration: " + file.setting + " is missing or unreadable")
+		}
+	}
+	return nil
 }
 
 func (homieClient *client) publish(subtopic string, payload string) string {
+	return homieClient.publishCorrelated("", subtopic, payload)
+}
+
+// publishCorrelated publishes payload, and tags the publication logs with
+// correlationId, if any.
+func (homieClient *client) publishCorrelated(correlationId string, subtopic string, payload string) string {
 	id := uuid.New()
-	homieClient.publishChan <- stateMessage{subtopic: subtopic, payload: payload, Uuid: id}
-	log.Trace("publication id", id, "submitted")
+	homieClient.publishChan <- stateMessage{subtopic: subtopic, payload: payload, Uuid: id, correlationId: correlationId}
+	homieClient.logger.WithFields(publicationFields(id, subtopic, correlationId)).Trace("publication submitted")
 	return id.String()
 }
 
+func publicationFields(id uuid.UUID, topic string, correlationId string) log.Fields {
+	fields := log.Fields{"id": id, "topic": topic}
+	if correlationId != "" {
+		fields[log.CorrelationKey] = correlationId
+	}
+	return fields
+}
+
 func (homieClient *client) unsubscribe(subtopic string) string {
 	id := uuid.New()
 	homieClient.unsubscribeChan <- unsubscribeMessage{subtopic: subtopic, Uuid: id}
-	log.Trace("unsubscription id", id, "submitted")
+	homieClient.logger.WithFields(log.Fields{"id": id, "topic": subtopic}).Trace("unsubscription submitted")
 	return id.String()
 }
 
 func (homieClient *client) subscribe(subtopic string, callback func(path string, payload string)) string {
 	id := uuid.New()
 	homieClient.subscribeChan <- subscribeMessage{subtopic: subtopic, callback: callback, Uuid: id}
-	log.Trace("subscription id", id, "submitted")
+	homieClient.logger.WithFields(log.Fields{"id": id, "topic": subtopic}).Trace("subscription submitted")
 	return id.String()
 }
 
+type configResult struct {
+	Status string            `json:"status"`
+	Error  string            `json:"error,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// subscribeConfig runs callback for each changeset received on
+// $implementation/config/set, and reports its outcome on
+// $implementation/config/result.
+func (homieClient *client) subscribeConfig(callback func(config string) error) {
+	homieClient.subscribe("$implementation/config/set", func(path string, payload string) {
+		result := configResult{Status: "ok"}
+		if err := callback(payload); err != nil {
+			homieClient.logger.Warn("config changeset rejected: ", err)
+			result = configResult{Status: "error", Error: err.Error()}
+			if invalid, ok := err.(config.ValidationError); ok {
+				result.Fields = invalid.Fields()
+			}
+		}
+		buf, _ := json.Marshal(result)
+		homieClient.publish("$implementation/config/result", string(buf))
+	})
+}
+
 func (homieClient *client) onConnectHandler(client mqtt.Client) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -109,34 +184,57 @@ func (homieClient *client) onConnectHandler(client mqtt.Client) {
 	homieClient.publish("$stats/interval", "10")
 	homieClient.publish("$localip", homieClient.Ip())
 	homieClient.publish("$fw/Name", homieClient.FirmwareName())
-	homieClient.publish("$fw/version", "0.0.1")
+	homieClient.publish("$fw/version", homieClient.FirmwareVersion())
 	homieClient.publish("$implementation", "vx-go-homie")
+	if homieClient.configPayload != "" {
+		homieClient.publish("$implementation/config", homieClient.configPayload)
+	}
 
 	// $online must be sent last
 	homieClient.publish("$online", "true")
 }
 
 func (homieClient *client) Start() error {
+	return homieClient.start(time.Time{})
+}
+
+// start connects to the mqtt server. It gives up after 10 tries, or once
+// deadline is reached if it is not zero.
+func (homieClient *client) start(deadline time.Time) error {
 	tries := 0
-	log.Debug("creating mqtt client")
-	homieClient.mqttClient = mqtt.NewClient(homieClient.getMQTTOptions())
+	homieClient.logger.Debug("creating mqtt client")
+	options, err := homieClient.getMQTTOptions()
+	if err != nil {
+		return err
+	}
+	homieClient.mqttClient = mqtt.NewClient(options)
 	homieClient.bootTime = time.Now()
-	log.Debug("connecting to mqtt server ", homieClient.Url())
+	homieClient.logger.Debug("connecting to mqtt server ", homieClient.Url())
 	for !homieClient.mqttClient.IsConnected() && tries < 10 {
 		if token := homieClient.mqttClient.Connect(); token.Wait() && token.Error() != nil {
 			fmt.Println(token.Error().Error())
-			log.Error(token.Error())
-			log.Warn("connection to mqtt server failed. will retry in 5 seconds")
+			homieClient.logger.Error(token.Error())
+			retryDelay := 5 * time.Second
+			if !deadline.IsZero() {
+				remaining := time.Until(deadline)
+				if remaining <= 0 {
+					return errors.New("could not connect to MQTT at " + homieClient.Url() + " before timeout")
+				}
+				if remaining < retryDelay {
+					retryDelay = remaining
+				}
+			}
+			homieClient.logger.Warn("connection to mqtt server failed. will retry in ", retryDelay)
 			select {
-			case <-time.After(5 * time.Second):
+			case <-time.After(retryDelay):
 				tries += 1
 			case <-homieClient.stopChan:
-				log.Fatal("could not connect to MQTT: we are being shutdown")
+				homieClient.logger.Warn("could not connect to MQTT: we are being shutdown")
 				homieClient.stopStatusChan <- true
 				return errors.New("could not connect to MQTT: we are being shutdown")
 			}
 		} else {
-			log.Debug("connected to mqtt server")
+			homieClient.logger.Debug("connected to mqtt server")
 		}
 	}
 	if tries >= 10 {
@@ -151,25 +249,28 @@ func (homieClient *client) loop() {
 	run := true
 	homieClient.stopChan = make(chan bool, 1)
 	homieClient.stopStatusChan = make(chan bool, 1)
-	log.Info("mqtt subsystem started")
+	atomic.StoreUint32(&homieClient.running, 1)
+	homieClient.logger.Info("mqtt subsystem started")
 	for run {
 		select {
 		case msg := <-homieClient.publishChan:
 			topic := homieClient.getDevicePrefix() + msg.subtopic
-			homieClient.mqttClient.Publish(topic, 1, true, msg.payload)
-			log.Trace("publication id", msg.Uuid.String(), "processed")
+			homieClient.mqttClient.Publish(topic, 1, !msg.transient, msg.payload)
+			if !msg.quiet {
+				homieClient.logger.WithFields(publicationFields(msg.Uuid, topic, msg.correlationId)).Trace("publication processed")
+			}
 			break
 		case msg := <-homieClient.unsubscribeChan:
 			topic := homieClient.getDevicePrefix() + msg.subtopic
 			homieClient.mqttClient.Unsubscribe(topic)
-			log.Trace("unsubscription id", msg.Uuid, "processed")
+			homieClient.logger.WithFields(log.Fields{"id": msg.Uuid, "topic": topic}).Trace("unsubscription processed")
 			break
 		case msg := <-homieClient.subscribeChan:
 			topic := homieClient.getDevicePrefix() + msg.subtopic
 			homieClient.mqttClient.Subscribe(topic, 1, func(mqttClient mqtt.Client, mqttMessage mqtt.Message) {
 				msg.callback(mqttMessage.Topic(), string(mqttMessage.Payload()))
 			})
-			log.Trace("subscription id", msg.Uuid, "processed")
+			homieClient.logger.WithFields(log.Fields{"id": msg.Uuid, "topic": topic}).Trace("subscription processed")
 			break
 		case <-homieClient.stopChan:
 			run = false
@@ -181,19 +282,40 @@ func (homieClient *client) loop() {
 	}
 	homieClient.mqttClient.Publish(homieClient.getDevicePrefix()+"$online", 1, true, "false")
 	homieClient.mqttClient.Disconnect(1000)
+	atomic.StoreUint32(&homieClient.running, 0)
 	homieClient.stopStatusChan <- true
 }
 
+// publishStats is called by the loop: provider values are published
+// directly, as they could fill the publication queue the loop consumes.
 func (homieClient *client) publishStats() {
 	homieClient.publish("$stats/uptime", strconv.Itoa(int(time.Since(homieClient.bootTime).Seconds())))
+	for name, provider := range homieClient.statsProviders {
+		for key, value := range provider() {
+			homieClient.mqttClient.Publish(homieClient.getDevicePrefix()+"$stats/"+name+"/"+key, 1, true, value)
+		}
+	}
 }
+// Stop stops the client, and waits for its loop to end. It returns at once
+// when the loop is not running, for example after a failed restart.
 func (homieClient *client) Stop() error {
-	log.Info("stopping mqtt subsystem")
+	if homieClient.stopChan == nil {
+		return nil
+	}
+	if !homieClient.isRunning() {
+		// only interrupt a connection in progress, if any
+		select {
+		case homieClient.stopChan <- true:
+		default:
+		}
+		return nil
+	}
+	homieClient.logger.Info("stopping mqtt subsystem")
 	homieClient.stopChan <- true
 	for {
 		select {
 		case <-homieClient.stopStatusChan:
-			log.Info("mqtt subsystem stopped")
+			homieClient.logger.Info("mqtt subsystem stopped")
 			return nil
 			break
 		}
@@ -203,8 +325,8 @@ func (homieClient *client) Stop() error {
 func (homieClient *client) AddNode(name string, nodeType string, properties []string, settables []SettableProperty) {
 	homieClient.nodes[name] = NewNode(
 		name, nodeType, properties, settables,
-		func(property string, value string) {
-			homieClient.publish(name+"/"+property, value)
+		func(correlationId string, property string, value string) {
+			homieClient.publishCorrelated(correlationId, name+"/"+property, value)
 		})
 	homieClient.publishNode(homieClient.nodes[name])
 }
@@ -218,17 +340,17 @@ func (homieClient *client) publishNode(node Node) {
 	propertyCsv := strings.Join(homieClient.nodes[name].Properties(), ",")
 	settablesList := []string{}
 	for _, property := range settables {
-		log.Debug("Subscribing for settable properties notifications: ", property.Name)
+		homieClient.logger.Debug("Subscribing for settable properties notifications: ", property.Name)
 		myProp := property
 		prop := myProp.Name
 		homieClient.subscribe(name+"/"+prop+"/set", func(path string, payload string) {
-			log.Debug("Settable property update (from path", path, "):", prop, " -> ", payload)
-			homieClient.nodes[name].Set(prop, payload)
+			homieClient.logger.Debug("Settable property update (from path", path, "):", prop, " -> ", payload)
+			homieClient.nodes[name].Set("", prop, payload)
 			myProp.Callback(payload)
 		})
 		homieClient.subscribe(name+"/"+prop, func(path string, payload string) {
-			log.Debug("restoring old value for property ", prop, ": ", payload)
-			homieClient.nodes[name].Set(prop, payload)
+			homieClient.logger.Debug("restoring old value for property ", prop, ": ", payload)
+			homieClient.nodes[name].Set("", prop, payload)
 			homieClient.unsubscribe(name + "/" + prop)
 		})
 		settablesList = append(settablesList, property.Name+":settable")
@@ -242,23 +364,31 @@ func (homieClient *client) publishNode(node Node) {
 }
 
 func (homieClient *client) Restart() error {
-	log.Info("restarting mqtt subsystem")
-	homieClient.Stop()
-	err := homieClient.Start()
+	return homieClient.restart(time.Time{})
+}
+
+func (homieClient *client) restart(deadline time.Time) error {
+	homieClient.logger.Info("restarting mqtt subsystem")
+	if homieClient.isRunning() {
+		homieClient.Stop()
+	}
+	err := homieClient.start(deadline)
 	if err == nil {
 		for _, node := range homieClient.Nodes() {
-			log.Info("restoring node ", node.Name())
+			homieClient.logger.Info("restoring node ", node.Name())
 			homieClient.publishNode(node)
 		}
 		for idx, callback := range homieClient.configCallbacks {
-			log.Info("restoring callback ", idx)
-			homieClient.subscribe("$implementation/config/set", func(path string, payload string) {
-				callback(payload)
-			})
+			homieClient.logger.Info("restoring callback ", idx)
+			homieClient.subscribeConfig(callback)
+		}
+		for _, subscription := range homieClient.subscriptions {
+			homieClient.logger.Info("restoring subscription ", subscription.subtopic)
+			homieClient.subscribe(subscription.subtopic, subscription.callback)
 		}
 		return nil
 	} else {
-		log.Fatal("could not finish restart: mqtt subsystem failed to start")
-		return errors.New("could not finish restart: mqtt subsystem failed to start")
+		homieClient.logger.Error("could not finish restart: ", err)
+		return errors.New("could not finish restart: " + err.Error())
 	}
 }
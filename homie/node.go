@@ -5,7 +5,9 @@ type Node interface {
 	Type() string
 	Properties() []string
 	Settables() []SettableProperty
-	Set(property string, value string)
+	// Set updates a property and publishes it. correlationId links the
+	// publication logs to the event that caused the update, and may be empty.
+	Set(correlationId string, property string, value string)
 }
 
 type node struct {
@@ -13,10 +15,10 @@ type node struct {
 	nodeType   string
 	properties map[string]string
 	settables  []SettableProperty
-	callback   func(property string, value string)
+	callback   func(correlationId string, property string, value string)
 }
 
-func NewNode(name string, nodeType string, properties []string, settables []SettableProperty, callback func(property string, value string)) Node {
+func NewNode(name string, nodeType string, properties []string, settables []SettableProperty, callback func(correlationId string, property string, value string)) Node {
 	newnode := &node{
 		name:       name,
 		nodeType:   nodeType,
@@ -44,9 +46,9 @@ func (node *node) Properties() []string {
 	return properties
 }
 
-func (node *node) Set(property string, value string) {
+func (node *node) Set(correlationId string, property string, value string) {
 	node.properties[property] = value
-	node.callback(property, value)
+	node.callback(correlationId, property, value)
 }
 func (node *node) Settables() []SettableProperty {
 	return node.settables
@@ -1,11 +1,13 @@
 package homie
 
 import (
+	"errors"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
 	"github.com/jbonachera/weathercontroller/config"
 	"github.com/jbonachera/weathercontroller/log"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,21 +22,48 @@ type Client interface {
 	Mac() string
 	Stop() error
 	FirmwareName() string
-	AddConfigCallback(func(config string))
+	FirmwareVersion() string
+	AddConfigCallback(func(config string) error)
+	PublishConfig(config string)
+	PublishLog(line string)
+	AddStatsProvider(name string, provider func() map[string]string)
+	Publish(subtopic string, payload string)
+	PublishTransient(subtopic string, payload string)
+	Subscribe(subtopic string, callback func(path string, payload string))
 	AddNode(name string, nodeType string, properties []string, settables []SettableProperty)
 	Nodes() map[string]Node
-	Reconfigure(prefix string, host string, port int, mqttPrefix string, ssl bool, sslAuth config.TLSFormat, deviceName string)
+	SetLogger(logger *log.Logger)
+	Reconfigure(prefix string, host string, port int, mqttPrefix string, ssl bool, sslAuth config.TLSFormat, deviceName string) error
 }
+
+const (
+	connectTimeout     = 10 * time.Second
+	reconfigureTimeout = 30 * time.Second
+)
+
 type SettableProperty struct {
 	Name     string
 	Callback func(payload string)
 }
 
+type connectionSettings struct {
+	name       string
+	prefix     string
+	server     string
+	port       int
+	mqttPrefix string
+	ssl        bool
+	ssl_config config.TLSFormat
+}
+
 // TODO track message processing time
 type stateMessage struct {
-	Uuid     uuid.UUID
-	subtopic string
-	payload  string
+	Uuid          uuid.UUID
+	correlationId string
+	subtopic      string
+	payload       string
+	transient     bool
+	quiet         bool
 }
 type subscribeMessage struct {
 	Uuid     uuid.UUID
@@ -58,6 +87,7 @@ type client struct {
 	ssl             bool
 	ssl_config      config.TLSFormat
 	firmwareName    string
+	firmwareVersion string
 	stopChan        chan bool
 	stopStatusChan  chan bool
 	publishChan     chan stateMessage
@@ -66,7 +96,18 @@ type client struct {
 	bootTime        time.Time
 	mqttClient      mqtt.Client
 	nodes           map[string]Node
-	configCallbacks []func(config string)
+	configCallbacks []func(config string) error
+	configPayload   string
+	subscriptions   []subscribeMessage
+	statsProviders  map[string]func() map[string]string
+	logger          *log.Logger
+	// running is accessed atomically, as the loop sets it while the MQTT
+	// callbacks and main read it
+	running uint32
+}
+
+func (homieClient *client) isRunning() bool {
+	return atomic.LoadUint32(&homieClient.running) == 1
 }
 
 func (homieClient *client) Id() string {
@@ -100,25 +141,111 @@ func (homieClient *client) Name() string {
 func (homieClient *client) FirmwareName() string {
 	return homieClient.firmwareName
 }
+func (homieClient *client) SetLogger(logger *log.Logger) {
+	homieClient.logger = logger
+}
+
+func (homieClient *client) FirmwareVersion() string {
+	return homieClient.firmwareVersion
+}
 func (homieClient *client) Nodes() map[string]Node {
 	return homieClient.nodes
 }
 
-func (homieClient *client) AddConfigCallback(callback func(config string)) {
-	homieClient.subscribe("$implementation/config/set", func(path string, payload string) {
-		callback(payload)
-	})
+func (homieClient *client) AddConfigCallback(callback func(config string) error) {
+	homieClient.subscribeConfig(callback)
 	homieClient.configCallbacks = append(homieClient.configCallbacks, callback)
 }
 
-func (homieClient *client) Reconfigure(prefix string, host string, port int, mqttPrefix string, ssl bool, sslConfig config.TLSFormat, deviceName string) {
-	homieClient.name = deviceName
-	homieClient.mqttPrefix = mqttPrefix
-	homieClient.prefix = prefix
-	homieClient.server = host
-	homieClient.port = port
-	homieClient.ssl = ssl
-	homieClient.ssl_config = sslConfig
-	log.Info("configuration changed: restarting")
-	homieClient.Restart()
+// AddStatsProvider registers a provider whose values are published along
+// with the uptime, as $stats/<name>/<key>.
+func (homieClient *client) AddStatsProvider(name string, provider func() map[string]string) {
+	homieClient.statsProviders[name] = provider
+}
+
+// PublishConfig publishes the given configuration on $implementation/config.
+// It is published again each time the client connects.
+func (homieClient *client) PublishConfig(config string) {
+	homieClient.configPayload = config
+	if homieClient.mqttClient != nil && homieClient.mqttClient.IsConnected() {
+		homieClient.publish("$implementation/config", config)
+	}
+}
+
+// PublishLog publishes a log line on $implementation/log, as a non-retained
+// message. The publication itself does not produce any log, so it can be used
+// as a remote log sink.
+func (homieClient *client) PublishLog(line string) {
+	if !homieClient.isRunning() {
+		return
+	}
+	homieClient.publishChan <- stateMessage{subtopic: "$implementation/log", payload: line, transient: true, quiet: true}
+}
+
+// Publish publishes a retained payload on a topic relative to the device
+// prefix.
+func (homieClient *client) Publish(subtopic string, payload string) {
+	homieClient.publish(subtopic, payload)
+}
+
+// PublishTransient publishes a non-retained payload on a topic relative to
+// the device prefix, for example a reply to a request.
+func (homieClient *client) PublishTransient(subtopic string, payload string) {
+	homieClient.publishChan <- stateMessage{subtopic: subtopic, payload: payload, Uuid: uuid.New(), transient: true}
+}
+
+// Subscribe registers callback for messages received on a topic relative to
+// the device prefix. The subscription is restored when the client restarts.
+func (homieClient *client) Subscribe(subtopic string, callback func(path string, payload string)) {
+	homieClient.subscribe(subtopic, callback)
+	homieClient.subscriptions = append(homieClient.subscriptions, subscribeMessage{subtopic: subtopic, callback: callback})
+}
+
+func (homieClient *client) settings() connectionSettings {
+	return connectionSettings{
+		name:       homieClient.name,
+		prefix:     homieClient.prefix,
+		server:     homieClient.server,
+		port:       homieClient.port,
+		mqttPrefix: homieClient.mqttPrefix,
+		ssl:        homieClient.ssl,
+		ssl_config: homieClient.ssl_config,
+	}
+}
+
+func (homieClient *client) applySettings(settings connectionSettings) {
+	homieClient.name = settings.name
+	homieClient.prefix = settings.prefix
+	homieClient.server = settings.server
+	homieClient.port = settings.port
+	homieClient.mqttPrefix = settings.mqttPrefix
+	homieClient.ssl = settings.ssl
+	homieClient.ssl_config = settings.ssl_config
+}
+
+// Reconfigure restarts the client with new connection settings. If the client
+// cannot connect within reconfigureTimeout, the previous settings are restored
+// and an error is returned.
+func (homieClient *client) Reconfigure(prefix string, host string, port int, mqttPrefix string, ssl bool, sslConfig config.TLSFormat, deviceName string) error {
+	previous := homieClient.settings()
+	homieClient.applySettings(connectionSettings{
+		name:       deviceName,
+		prefix:     prefix,
+		server:     host,
+		port:       port,
+		mqttPrefix: mqttPrefix,
+		ssl:        ssl,
+		ssl_config: sslConfig,
+	})
+	homieClient.logger.Info("configuration changed: restarting")
+	err := homieClient.restart(time.Now().Add(reconfigureTimeout))
+	if err == nil {
+		return nil
+	}
+	homieClient.logger.Error("new configuration failed: rolling back to previous configuration")
+	homieClient.applySettings(previous)
+	if rollbackErr := homieClient.restart(time.Time{}); rollbackErr != nil {
+		homieClient.logger.Fatal("could not restore previous configuration: ", rollbackErr)
+	}
+	return errors.New("new configuration rolled back: " + err.Error())
 }
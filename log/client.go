@@ -1,56 +1,138 @@
 package log
 
-import "fmt"
+import "time"
 
-var logLevel int = INFO
-var closed bool = false
+// std is the default logger, used by the package level functions.
+var std = New(NewStdoutSink(TextEncoder))
 
-func publish(severity int, a ...interface{}) {
-	if !closed {
-		if severity >= logLevel {
-			msg, err := NewMessage(severity, fmt.Sprint(a...))
-			if err == nil {
-				logChan <- msg
-			} else {
-				fmt.Println(err)
-			}
-		}
-	}
+// Default returns the default logger.
+func Default() *Logger {
+	return std
+}
+
+// Named returns a logger for the named subsystem, derived from the default
+// logger.
+func Named(name string) *Logger {
+	return std.Named(name)
 }
 
 func Info(a ...interface{}) {
-	publish(INFO, a...)
+	std.Info(a...)
 }
 
 func Warn(a ...interface{}) {
-	publish(WARN, a...)
+	std.Warn(a...)
 }
 
 func Fatal(a ...interface{}) {
-	publish(FATAL, a...)
+	std.Fatal(a...)
+}
+
+func Critical(a ...interface{}) {
+	std.Critical(a...)
+}
+
+func AddShutdownHook(hook func()) {
+	std.AddShutdownHook(hook)
 }
 
 func Debug(a ...interface{}) {
-	publish(DEBUG, a...)
+	std.Debug(a...)
 }
 
 func Error(a ...interface{}) {
-	publish(ERROR, a...)
+	std.Error(a...)
 }
 
 func Trace(a ...interface{}) {
-	publish(TRACE, a...)
+	std.Trace(a...)
+}
+
+func WithFields(fields Fields) Entry {
+	return std.WithFields(fields)
+}
+
+func WithField(key string, value interface{}) Entry {
+	return std.WithField(key, value)
 }
 
 func SetLevel(severity int) {
-	if severity <= FATAL {
-		logLevel = severity
-	}
+	std.SetLevel(severity)
+}
+
+func SetSubsystemLevel(name string, severity int) {
+	std.SetSubsystemLevel(name, severity)
+}
+
+func ResetSubsystemLevels() {
+	std.ResetSubsystemLevels()
+}
+
+func Levels() string {
+	return std.Levels()
+}
+
+func SetLevels(spec string) error {
+	return std.SetLevels(spec)
+}
+
+func ReplaceLevels(spec string) error {
+	return std.ReplaceLevels(spec)
+}
+
+func IncreaseVerbosity() {
+	std.IncreaseVerbosity()
+}
+
+func DecreaseVerbosity() {
+	std.DecreaseVerbosity()
+}
+
+func SetOverflowPolicy(policy OverflowPolicy) {
+	std.SetOverflowPolicy(policy)
+}
+
+func Dropped() uint64 {
+	return std.Dropped()
+}
+
+func SetDeduplication(window time.Duration) {
+	std.SetDeduplication(window)
+}
+
+func SetRateLimits(limits map[string]int) {
+	std.SetRateLimits(limits)
+}
+
+func Suppressed() uint64 {
+	return std.Suppressed()
+}
+
+func Stats() Statistics {
+	return std.Stats()
+}
+
+func Recent(query Query) []Message {
+	return std.Recent(query)
+}
+
+func SetHistorySize(size int) {
+	std.SetHistorySize(size)
+}
+
+func SetSinks(sinks ...Sink) {
+	std.SetSinks(sinks...)
+}
+
+func SetRemote(severity int, rate int, publish func(msg Message)) {
+	std.SetRemote(severity, rate, publish)
+}
+
+func StopRemote() {
+	std.StopRemote()
 }
 
 func Flush() {
-	Debug("flushing logs...")
-	closed = true
-	close(logChan)
-	<-doneChan
+	std.Debug("flushing logs...")
+	std.Close()
 }
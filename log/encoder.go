@@ -0,0 +1,129 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoder renders a message as a single log line.
+type Encoder interface {
+	Encode(msg Message) string
+}
+
+// bodyEncoder is implemented by encoders able to render a message without
+// its timestamp and severity, for sinks recording them separately.
+type bodyEncoder interface {
+	EncodeBody(msg Message) string
+}
+
+// encodeBody renders a message without its timestamp and severity, when the
+// encoder supports it.
+func encodeBody(encoder Encoder, msg Message) string {
+	if body, ok := encoder.(bodyEncoder); ok {
+		return body.EncodeBody(msg)
+	}
+	return encoder.Encode(msg)
+}
+
+type textEncoder struct{}
+type logfmtEncoder struct{}
+type jsonEncoder struct{}
+
+var (
+	TextEncoder   Encoder = textEncoder{}
+	LogfmtEncoder Encoder = logfmtEncoder{}
+	JSONEncoder   Encoder = jsonEncoder{}
+)
+
+// ParseEncoder returns the encoder matching the given name: "text", "logfmt"
+// or "json".
+func ParseEncoder(name string) (Encoder, error) {
+	switch strings.ToLower(name) {
+	case "", "text":
+		return TextEncoder, nil
+	case "logfmt":
+		return LogfmtEncoder, nil
+	case "json":
+		return JSONEncoder, nil
+	default:
+		return nil, errors.New("unknown log format: " + name)
+	}
+}
+
+func levelName(severity int) string {
+	return strings.ToLower(strings.TrimSpace(Severity(severity)))
+}
+
+// logfmtValue quotes values that would be ambiguous in a key=value list.
+func logfmtValue(value interface{}) string {
+	str := fmt.Sprint(value)
+	if str == "" || strings.ContainsAny(str, " =\"\t\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+func appendFields(builder *strings.Builder, fields Fields) {
+	for _, key := range fields.Keys() {
+		builder.WriteString(" ")
+		builder.WriteString(key)
+		builder.WriteString("=")
+		builder.WriteString(logfmtValue(fields[key]))
+	}
+}
+
+func (encoder textEncoder) Encode(msg Message) string {
+	return fmt.Sprintf("%s [%s] %s", msg.CreationDate().Format(time.RFC3339), Severity(msg.Severity()), encoder.EncodeBody(msg))
+}
+
+func (textEncoder) EncodeBody(msg Message) string {
+	builder := &strings.Builder{}
+	builder.WriteString(msg.Payload())
+	appendFields(builder, msg.Fields())
+	return builder.String()
+}
+
+func (encoder logfmtEncoder) Encode(msg Message) string {
+	return fmt.Sprintf("time=%s level=%s %s", msg.CreationDate().Format(time.RFC3339), levelName(msg.Severity()), encoder.EncodeBody(msg))
+}
+
+func (logfmtEncoder) EncodeBody(msg Message) string {
+	builder := &strings.Builder{}
+	builder.WriteString("msg=" + logfmtValue(msg.Payload()))
+	appendFields(builder, msg.Fields())
+	return builder.String()
+}
+
+func (jsonEncoder) Encode(msg Message) string {
+	return encodeJSON(msg, map[string]interface{}{
+		"time":  msg.CreationDate().Format(time.RFC3339Nano),
+		"level": levelName(msg.Severity()),
+		"msg":   msg.Payload(),
+	})
+}
+
+func (jsonEncoder) EncodeBody(msg Message) string {
+	return encodeJSON(msg, map[string]interface{}{"msg": msg.Payload()})
+}
+
+// encodeJSON adds the message fields to entry, and encodes it.
+func encodeJSON(msg Message, entry map[string]interface{}) string {
+	for key, value := range msg.Fields() {
+		if _, reserved := entry[key]; reserved {
+			key = "fields." + key
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","msg":%q}`, "could not encode log message: "+err.Error())
+	}
+	return string(buf)
+}
@@ -0,0 +1,48 @@
+package log
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEncoders(t *testing.T) {
+	msg, _ := NewMessageWithFields(WARN, "sensor timeout", Fields{"sensor": 12, "topic": "devices/abc/12"})
+	text := TextEncoder.Encode(msg)
+	if !strings.HasSuffix(text, "[WARN ] sensor timeout sensor=12 topic=devices/abc/12") {
+		t.Error("TextEncoder should append sorted fields to the log line: got ", text)
+	}
+	logfmt := LogfmtEncoder.Encode(msg)
+	if !strings.HasSuffix(logfmt, `level=warn msg="sensor timeout" sensor=12 topic=devices/abc/12`) {
+		t.Error("LogfmtEncoder should quote values and append fields: got ", logfmt)
+	}
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(JSONEncoder.Encode(msg)), &decoded); err != nil {
+		t.Fatal("JSONEncoder should produce valid JSON: got ", err)
+	}
+	if decoded["level"] != "warn" || decoded["msg"] != "sensor timeout" || decoded["sensor"] != float64(12) {
+		t.Error("JSONEncoder should include the level, the payload and the fields: got ", decoded)
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	msg, _ := NewMessageWithFields(WARN, "sensor timeout", Fields{"sensor": 12})
+	for encoder, expected := range map[Encoder]string{
+		TextEncoder:   "sensor timeout sensor=12",
+		LogfmtEncoder: `msg="sensor timeout" sensor=12`,
+		JSONEncoder:   `{"msg":"sensor timeout","sensor":12}`,
+	} {
+		if body := encodeBody(encoder, msg); body != expected {
+			t.Error("encodeBody should omit the timestamp and the severity: got ", body)
+		}
+	}
+}
+
+func TestParseEncoder(t *testing.T) {
+	if encoder, err := ParseEncoder("logfmt"); err != nil || encoder != LogfmtEncoder {
+		t.Error("ParseEncoder should return the logfmt encoder: got ", err)
+	}
+	if _, err := ParseEncoder("xml"); err == nil {
+		t.Error("ParseEncoder should reject unknown formats")
+	}
+}
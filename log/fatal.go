@@ -0,0 +1,62 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownTimeout bounds the time given to shutdown hooks before exiting.
+const shutdownTimeout = 10 * time.Second
+
+// exit is replaced in tests.
+var exit = os.Exit
+
+// AddShutdownHook registers a hook run by Fatal before exiting, for example
+// to stop a subsystem. Hooks run in registration order.
+func (logger *Logger) AddShutdownHook(hook func()) {
+	logger.core.hooksLock.Lock()
+	defer logger.core.hooksLock.Unlock()
+	logger.core.hooks = append(logger.core.hooks, hook)
+}
+
+// Fatal logs a message at the FATAL level, runs the shutdown hooks, flushes
+// the sinks and exits with a non-zero code. Use Critical to log at the
+// FATAL level and continue.
+func (logger *Logger) Fatal(a ...interface{}) {
+	logger.publish(FATAL, nil, a...)
+	logger.shutdown()
+}
+
+// Critical logs a message at the FATAL level, without exiting.
+func (logger *Logger) Critical(a ...interface{}) {
+	logger.publish(FATAL, nil, a...)
+}
+
+// shutdown runs the shutdown hooks, closes the logger and exits. Only the
+// first call does so: later calls, for example from a hook, return
+// immediately.
+func (logger *Logger) shutdown() {
+	c := logger.core
+	if !atomic.CompareAndSwapUint32(&c.fatal, 0, 1) {
+		return
+	}
+	c.hooksLock.Lock()
+	hooks := append([]func(){}, c.hooks...)
+	c.hooksLock.Unlock()
+	done := make(chan bool, 1)
+	go func() {
+		for _, hook := range hooks {
+			hook()
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		fmt.Fprintln(os.Stderr, "shutdown hooks did not finish in", shutdownTimeout)
+	}
+	logger.Close()
+	exit(1)
+}
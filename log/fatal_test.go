@@ -0,0 +1,41 @@
+package log
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFatal(t *testing.T) {
+	code := -1
+	exit = func(c int) {
+		code = c
+	}
+	defer func() {
+		exit = os.Exit
+	}()
+	sink := &memorySink{}
+	logger := New(sink)
+	hooks := []string{}
+	logger.AddShutdownHook(func() {
+		hooks = append(hooks, "homie")
+		logger.Fatal("nested fatal")
+	})
+	logger.AddShutdownHook(func() {
+		hooks = append(hooks, "radio")
+	})
+	logger.Critical("still running")
+	if code != -1 {
+		t.Fatal("Critical should not exit")
+	}
+	logger.Named("homie").Fatal("could not load TLS certificate")
+	if code != 1 {
+		t.Error("Fatal should exit with a non-zero code: got ", code)
+	}
+	if len(hooks) != 2 || hooks[0] != "homie" || hooks[1] != "radio" {
+		t.Error("Fatal should run the shutdown hooks once, in order: got ", hooks)
+	}
+	last := sink.messages[len(sink.messages)-1]
+	if last.Payload() != "log subsystem flushed and closed" {
+		t.Error("Fatal should flush the logger before exiting: got ", last.Payload())
+	}
+}
@@ -0,0 +1,72 @@
+package log
+
+import "sort"
+
+// Fields are key/value pairs attached to a message, such as a sensor id or
+// an MQTT topic.
+type Fields map[string]interface{}
+
+// Keys returns the field names, sorted.
+func (fields Fields) Keys() []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CorrelationKey is the field linking the messages logged while processing
+// the same radio packet, from its reception to its MQTT publications.
+const CorrelationKey = "correlation_id"
+
+// Entry attaches fields to the messages logged through it.
+type Entry struct {
+	logger *Logger
+	fields Fields
+}
+
+func (entry Entry) WithFields(fields Fields) Entry {
+	merged := make(Fields, len(entry.fields)+len(fields))
+	for key, value := range entry.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return Entry{logger: entry.logger, fields: merged}
+}
+
+func (entry Entry) WithField(key string, value interface{}) Entry {
+	return entry.WithFields(Fields{key: value})
+}
+
+func (entry Entry) Info(a ...interface{}) {
+	entry.logger.publish(INFO, entry.fields, a...)
+}
+
+func (entry Entry) Warn(a ...interface{}) {
+	entry.logger.publish(WARN, entry.fields, a...)
+}
+
+// Fatal logs like Logger.Fatal, and exits.
+func (entry Entry) Fatal(a ...interface{}) {
+	entry.logger.publish(FATAL, entry.fields, a...)
+	entry.logger.shutdown()
+}
+
+func (entry Entry) Critical(a ...interface{}) {
+	entry.logger.publish(FATAL, entry.fields, a...)
+}
+
+func (entry Entry) Debug(a ...interface{}) {
+	entry.logger.publish(DEBUG, entry.fields, a...)
+}
+
+func (entry Entry) Error(a ...interface{}) {
+	entry.logger.publish(ERROR, entry.fields, a...)
+}
+
+func (entry Entry) Trace(a ...interface{}) {
+	entry.logger.publish(TRACE, entry.fields, a...)
+}
@@ -0,0 +1,125 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const rotatedSuffixFormat = "20060102-150405.000000000"
+
+type fileSink struct {
+	lock       sync.Mutex
+	path       string
+	encoder    Encoder
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+// NewFileSink appends messages to the file at path. The file is rotated when
+// it grows over maxSize bytes, or when it was opened more than maxAge ago.
+// Only the maxBackups most recent rotated files are kept.
+// A zero maxSize, maxAge or maxBackups disables the matching limit.
+func NewFileSink(path string, encoder Encoder, maxSize int64, maxAge time.Duration, maxBackups int) (Sink, error) {
+	sink := &fileSink{path: path, encoder: encoder, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *fileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	sink.opened = time.Now()
+	return nil
+}
+
+func (sink *fileSink) Write(msg Message) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.file == nil {
+		return os.ErrClosed
+	}
+	line := sink.encoder.Encode(msg) + "\n"
+	if sink.shouldRotate(int64(len(line))) {
+		if err := sink.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := sink.file.WriteString(line)
+	sink.size += int64(n)
+	return err
+}
+
+func (sink *fileSink) shouldRotate(length int64) bool {
+	if sink.size == 0 {
+		return false
+	}
+	if sink.maxSize > 0 && sink.size+length > sink.maxSize {
+		return true
+	}
+	return sink.maxAge > 0 && time.Since(sink.opened) > sink.maxAge
+}
+
+func (sink *fileSink) rotate() error {
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	sink.file = nil
+	if err := os.Rename(sink.path, sink.path+"."+time.Now().Format(rotatedSuffixFormat)); err != nil {
+		return err
+	}
+	if err := sink.open(); err != nil {
+		return err
+	}
+	return sink.removeOldBackups()
+}
+
+func (sink *fileSink) removeOldBackups() error {
+	if sink.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(sink.path + ".*")
+	if err != nil {
+		return err
+	}
+	// rotated file suffixes sort in chronological order
+	sort.Strings(backups)
+	for len(backups) > sink.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (sink *fileSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
@@ -0,0 +1,36 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "weathercontroller.log")
+	sink, err := NewFileSink(path, TextEncoder, 100, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	msg, _ := NewMessage(INFO, "a message long enough to fill the file quickly")
+	for i := 0; i < 10; i++ {
+		if err := sink.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Error("NewFileSink should keep maxBackups rotated files: got ", backups)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > 100 {
+		t.Error("NewFileSink should rotate files over maxSize: got ", info.Size(), err)
+	}
+}
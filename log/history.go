@@ -0,0 +1,168 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const historySize = 500
+
+// history keeps the most recent messages written by the log routine, in a
+// ring buffer.
+type history struct {
+	lock     sync.RWMutex
+	messages []Message
+	next     int
+	full     bool
+}
+
+func newHistory(size int) *history {
+	return &history{messages: make([]Message, size)}
+}
+
+func (h *history) add(msg Message) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.messages) == 0 {
+		return
+	}
+	h.messages[h.next] = msg
+	h.next = (h.next + 1) % len(h.messages)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// snapshot returns the kept messages, oldest first.
+func (h *history) snapshot() []Message {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if !h.full {
+		return append([]Message{}, h.messages[:h.next]...)
+	}
+	return append(append([]Message{}, h.messages[h.next:]...), h.messages[:h.next]...)
+}
+
+func (h *history) resize(size int) {
+	kept := h.snapshot()
+	if len(kept) > size {
+		kept = kept[len(kept)-size:]
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.messages = make([]Message, size)
+	h.next = copy(h.messages, kept)
+	h.full = false
+	if size > 0 && h.next == size {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Query selects messages from the history. Zero values match everything.
+type Query struct {
+	// Severity is the lowest severity returned.
+	Severity int
+	Since    time.Time
+	Until    time.Time
+	// Text is searched, ignoring case, in the payload and field values.
+	Text string
+	// Limit keeps only the most recent matching messages.
+	Limit int
+}
+
+type queryFormat struct {
+	Level string    `json:"level,omitempty"`
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+	Text  string    `json:"text,omitempty"`
+	Limit int       `json:"limit,omitempty"`
+}
+
+// ParseQuery parses a JSON query, for example
+// {"level": "warn", "since": "2019-01-02T15:04:05Z", "text": "radio", "limit": 50}.
+// An empty payload selects every message.
+func ParseQuery(payload string) (Query, error) {
+	query := Query{}
+	if strings.TrimSpace(payload) == "" {
+		return query, nil
+	}
+	format := queryFormat{}
+	if err := json.Unmarshal([]byte(payload), &format); err != nil {
+		return query, errors.New("invalid log query: " + err.Error())
+	}
+	if format.Level != "" {
+		severity, err := ParseSeverity(format.Level)
+		if err != nil {
+			return query, err
+		}
+		query.Severity = severity
+	}
+	if format.Limit < 0 {
+		return query, errors.New("invalid log query: limit must not be negative")
+	}
+	query.Since, query.Until, query.Text, query.Limit = format.Since, format.Until, format.Text, format.Limit
+	return query, nil
+}
+
+func (query Query) match(msg Message) bool {
+	if msg.Severity() < query.Severity {
+		return false
+	}
+	if !query.Since.IsZero() && msg.CreationDate().Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && msg.CreationDate().After(query.Until) {
+		return false
+	}
+	if query.Text == "" {
+		return true
+	}
+	text := strings.ToLower(query.Text)
+	if strings.Contains(strings.ToLower(msg.Payload()), text) {
+		return true
+	}
+	for _, value := range msg.Fields() {
+		if strings.Contains(strings.ToLower(fmt.Sprint(value)), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Recent returns the messages from the history matching query, oldest
+// first.
+func (logger *Logger) Recent(query Query) []Message {
+	matching := []Message{}
+	for _, msg := range logger.core.history.snapshot() {
+		if query.match(msg) {
+			matching = append(matching, msg)
+		}
+	}
+	if query.Limit > 0 && len(matching) > query.Limit {
+		matching = matching[len(matching)-query.Limit:]
+	}
+	return matching
+}
+
+// SetHistorySize changes the number of messages kept in the history. The
+// most recent messages are kept.
+func (logger *Logger) SetHistorySize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	logger.core.history.resize(size)
+}
+
+// EncodeJSON renders messages as a JSON array, using JSONEncoder.
+func EncodeJSON(messages []Message) string {
+	encoded := make([]string, len(messages))
+	for idx, msg := range messages {
+		encoded[idx] = JSONEncoder.Encode(msg)
+	}
+	return "[" + strings.Join(encoded, ",") + "]"
+}
@@ -0,0 +1,54 @@
+package log
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	for _, payload := range []string{"one", "two", "three", "four"} {
+		msg, _ := NewMessage(INFO, payload)
+		h.add(msg)
+	}
+	kept := h.snapshot()
+	if len(kept) != 3 || kept[0].Payload() != "two" || kept[2].Payload() != "four" {
+		t.Error("history should keep the most recent messages, oldest first: got ", len(kept), " messages")
+	}
+	h.resize(2)
+	kept = h.snapshot()
+	if len(kept) != 2 || kept[0].Payload() != "three" {
+		t.Error("history should keep the most recent messages when resized: got ", len(kept), " messages")
+	}
+}
+
+func TestRecent(t *testing.T) {
+	logger := New()
+	logger.SetLevel(DEBUG)
+	logger.Debug("packet received")
+	logger.Named("radio").Warn("invalid checksum")
+	logger.Error("connection lost")
+	logger.Close()
+	if messages := logger.Recent(Query{Severity: WARN}); len(messages) != 2 {
+		t.Error("Recent should filter messages by severity: got ", len(messages), " messages")
+	}
+	if messages := logger.Recent(Query{Text: "RADIO"}); len(messages) != 1 || messages[0].Payload() != "invalid checksum" {
+		t.Error("Recent should search text in payloads and fields: got ", len(messages), " messages")
+	}
+	if messages := logger.Recent(Query{Until: time.Now().Add(-time.Hour)}); len(messages) != 0 {
+		t.Error("Recent should filter messages by time: got ", len(messages), " messages")
+	}
+	if messages := logger.Recent(Query{Limit: 1}); len(messages) != 1 || messages[0].Payload() != "log subsystem flushed and closed" {
+		t.Error("Recent should keep the most recent messages when limited: got ", messages)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	query, err := ParseQuery(`{"level": "warn", "since": "2019-01-02T15:04:05Z", "text": "radio", "limit": 50}`)
+	if err != nil || query.Severity != WARN || query.Since.Year() != 2019 || query.Text != "radio" || query.Limit != 50 {
+		t.Error("ParseQuery should parse a valid query: got ", query, err)
+	}
+	if _, err := ParseQuery(`{"level": "verbose"}`); err == nil {
+		t.Error("ParseQuery should reject unknown severities")
+	}
+}
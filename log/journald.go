@@ -0,0 +1,91 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+type journaldSink struct {
+	lock       sync.Mutex
+	identifier string
+	conn       net.Conn
+}
+
+// NewJournaldSink sends messages to journald with its native protocol, so
+// that the priority and the message fields can be queried with journalctl.
+func NewJournaldSink(identifier string) Sink {
+	return &journaldSink{identifier: identifier}
+}
+
+// journaldFieldName converts a field name to the journald format: uppercase
+// letters, digits and underscores, not starting with an underscore.
+func journaldFieldName(name string) string {
+	converted := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	converted = strings.TrimLeft(converted, "_")
+	if converted == "" || (converted[0] >= '0' && converted[0] <= '9') {
+		converted = "FIELD_" + converted
+	}
+	return converted
+}
+
+func writeJournaldField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	// values spanning several lines are sent with an explicit length
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (sink *journaldSink) Write(msg Message) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	buf := &bytes.Buffer{}
+	writeJournaldField(buf, "MESSAGE", msg.Payload())
+	writeJournaldField(buf, "PRIORITY", strconv.Itoa(syslogSeverities[msg.Severity()]))
+	writeJournaldField(buf, "SYSLOG_IDENTIFIER", sink.identifier)
+	fields := msg.Fields()
+	for _, key := range fields.Keys() {
+		writeJournaldField(buf, journaldFieldName(key), fmt.Sprint(fields[key]))
+	}
+	if sink.conn == nil {
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	_, err := sink.conn.Write(buf.Bytes())
+	return err
+}
+
+func (sink *journaldSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.conn == nil {
+		return nil
+	}
+	err := sink.conn.Close()
+	sink.conn = nil
+	return err
+}
@@ -0,0 +1,16 @@
+package log
+
+import "testing"
+
+func TestJournaldFieldName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"sensor":         "SENSOR",
+		"correlation-id": "CORRELATION_ID",
+		"_private":       "PRIVATE",
+		"1st":            "FIELD_1ST",
+	} {
+		if converted := journaldFieldName(name); converted != expected {
+			t.Error("journaldFieldName should convert ", name, " to ", expected, ": got ", converted)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const queueSize = 50
+
+// core holds the state shared by a logger and every logger derived from it
+// with Named: the queue, the log routine, the levels and the sinks.
+type core struct {
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	dropped      uint64
+	pendingDrops uint64
+	fatal        uint32
+	policy       atomic.Value
+
+	queue      chan Message
+	done       chan bool
+	closed     bool
+	closedLock sync.RWMutex
+
+	level      int
+	levels     map[string]int
+	levelsLock sync.RWMutex
+
+	sinks     []Sink
+	sinksLock sync.RWMutex
+
+	remote     *remoteSink
+	remoteLock sync.Mutex
+
+	stats    counters
+	history  *history
+	throttle *throttle
+
+	hooks     []func()
+	hooksLock sync.Mutex
+}
+
+// Logger logs messages for a named subsystem, such as "homie" or "radio".
+// Each subsystem can have its own level, overriding the global one.
+type Logger struct {
+	core *core
+	name string
+}
+
+// New creates a logger writing to the given sinks, and starts its log
+// routine. It must be closed with Close.
+func New(sinks ...Sink) *Logger {
+	c := &core{
+		queue:    make(chan Message, queueSize),
+		done:     make(chan bool, 1),
+		level:    INFO,
+		levels:   map[string]int{},
+		sinks:    sinks,
+		history:  newHistory(historySize),
+		throttle: newThrottle(),
+	}
+	c.policy.Store(OverflowPolicy{Mode: Block})
+	logger := &Logger{core: c}
+	logger.Info("log subsystem started")
+	go logger.loop()
+	return logger
+}
+
+// Named returns a logger for the named subsystem, sharing the queue, levels
+// and sinks of logger.
+func (logger *Logger) Named(name string) *Logger {
+	return &Logger{core: logger.core, name: name}
+}
+
+func (logger *Logger) Name() string {
+	return logger.name
+}
+
+func (logger *Logger) WithFields(fields Fields) Entry {
+	return Entry{logger: logger}.WithFields(fields)
+}
+
+func (logger *Logger) WithField(key string, value interface{}) Entry {
+	return Entry{logger: logger}.WithField(key, value)
+}
+
+func (logger *Logger) Info(a ...interface{}) {
+	logger.publish(INFO, nil, a...)
+}
+
+func (logger *Logger) Warn(a ...interface{}) {
+	logger.publish(WARN, nil, a...)
+}
+
+func (logger *Logger) Debug(a ...interface{}) {
+	logger.publish(DEBUG, nil, a...)
+}
+
+func (logger *Logger) Error(a ...interface{}) {
+	logger.publish(ERROR, nil, a...)
+}
+
+func (logger *Logger) Trace(a ...interface{}) {
+	logger.publish(TRACE, nil, a...)
+}
+
+func (logger *Logger) publish(severity int, fields Fields, a ...interface{}) {
+	if severity < logger.core.levelOf(logger.name) {
+		return
+	}
+	if logger.name != "" {
+		fields = Entry{fields: fields}.WithField("subsystem", logger.name).fields
+	}
+	msg, err := NewMessageWithFields(severity, fmt.Sprint(a...), fields)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	summaries, admitted := logger.core.throttle.admit(msg, logger.name, time.Now(), &logger.core.stats)
+	logger.core.closedLock.RLock()
+	defer logger.core.closedLock.RUnlock()
+	if logger.core.closed {
+		return
+	}
+	for _, summary := range summaries {
+		logger.core.enqueue(summary)
+	}
+	if admitted {
+		logger.core.enqueue(msg)
+	}
+}
+
+// Close writes the pending messages, closes the sinks, and stops the log
+// routine. Messages logged after Close are dropped.
+func (logger *Logger) Close() {
+	c := logger.core
+	c.closedLock.Lock()
+	if c.closed {
+		c.closedLock.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.queue)
+	c.closedLock.Unlock()
+	<-c.done
+	logger.StopRemote()
+	logger.SetSinks()
+}
+
+// levelOf returns the level of the named subsystem, or the global level if
+// the subsystem has none.
+func (c *core) levelOf(name string) int {
+	c.levelsLock.RLock()
+	defer c.levelsLock.RUnlock()
+	if severity, found := c.levels[name]; found {
+		return severity
+	}
+	return c.level
+}
+
+// SetLevel changes the global level.
+func (logger *Logger) SetLevel(severity int) {
+	if severity < TRACE || severity > FATAL {
+		return
+	}
+	logger.core.levelsLock.Lock()
+	defer logger.core.levelsLock.Unlock()
+	logger.core.level = severity
+}
+
+func (logger *Logger) SetSubsystemLevel(name string, severity int) {
+	if severity < TRACE || severity > FATAL {
+		return
+	}
+	logger.core.levelsLock.Lock()
+	defer logger.core.levelsLock.Unlock()
+	logger.core.levels[name] = severity
+}
+
+// ResetSubsystemLevels makes every subsystem use the global level.
+func (logger *Logger) ResetSubsystemLevels() {
+	logger.core.levelsLock.Lock()
+	defer logger.core.levelsLock.Unlock()
+	logger.core.levels = map[string]int{}
+}
+
+// Levels describes the global level and the subsystem levels, for example
+// "debug,homie=trace,radio=info".
+func (logger *Logger) Levels() string {
+	logger.core.levelsLock.RLock()
+	defer logger.core.levelsLock.RUnlock()
+	specs := []string{}
+	for name, severity := range logger.core.levels {
+		specs = append(specs, name+"="+levelName(severity))
+	}
+	sort.Strings(specs)
+	return strings.Join(append([]string{levelName(logger.core.level)}, specs...), ",")
+}
+
+// SetLevels parses a comma separated list of levels, in the format returned
+// by Levels, and applies it. An entry without a subsystem name changes the
+// global level. Nothing is applied if an entry is invalid.
+func (logger *Logger) SetLevels(spec string) error {
+	global, subsystems, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	logger.applyLevels(global, subsystems)
+	return nil
+}
+
+// ReplaceLevels works like SetLevels, but subsystems missing from spec are
+// reset to the global level. The levels are replaced at once, so that no
+// message is filtered by a partial set.
+func (logger *Logger) ReplaceLevels(spec string) error {
+	global, subsystems, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	logger.core.levelsLock.Lock()
+	defer logger.core.levelsLock.Unlock()
+	if global >= 0 {
+		logger.core.level = global
+	}
+	logger.core.levels = subsystems
+	return nil
+}
+
+func parseLevels(spec string) (int, map[string]int, error) {
+	global := -1
+	subsystems := map[string]int{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name := ""
+		if idx := strings.Index(entry, "="); idx >= 0 {
+			name, entry = strings.TrimSpace(entry[:idx]), entry[idx+1:]
+			if name == "" {
+				return -1, nil, errors.New("missing subsystem name in log level: " + entry)
+			}
+		}
+		severity, err := ParseSeverity(entry)
+		if err != nil {
+			return -1, nil, err
+		}
+		if name == "" {
+			global = severity
+		} else {
+			subsystems[name] = severity
+		}
+	}
+	return global, subsystems, nil
+}
+
+func (logger *Logger) applyLevels(global int, subsystems map[string]int) {
+	logger.core.levelsLock.Lock()
+	defer logger.core.levelsLock.Unlock()
+	levels := map[string]int{}
+	for name, severity := range logger.core.levels {
+		levels[name] = severity
+	}
+	for name, severity := range subsystems {
+		levels[name] = severity
+	}
+	if global >= 0 {
+		logger.core.level = global
+	}
+	logger.core.levels = levels
+}
+
+// IncreaseVerbosity lowers the global level and every subsystem level by one
+// step, down to TRACE.
+func (logger *Logger) IncreaseVerbosity() {
+	logger.shiftLevels(-1)
+}
+
+// DecreaseVerbosity raises the global level and every subsystem level by one
+// step, up to FATAL.
+func (logger *Logger) DecreaseVerbosity() {
+	logger.shiftLevels(1)
+}
+
+func (logger *Logger) shiftLevels(step int) {
+	logger.core.levelsLock.Lock()
+	defer logger.core.levelsLock.Unlock()
+	shift := func(severity int) int {
+		severity += step
+		if severity < TRACE {
+			return TRACE
+		}
+		if severity > FATAL {
+			return FATAL
+		}
+		return severity
+	}
+	logger.core.level = shift(logger.core.level)
+	for name, severity := range logger.core.levels {
+		logger.core.levels[name] = shift(severity)
+	}
+}
@@ -0,0 +1,74 @@
+package log
+
+import "testing"
+
+// memorySink keeps written messages, for tests.
+type memorySink struct {
+	messages []Message
+}
+
+func (sink *memorySink) Write(msg Message) error {
+	sink.messages = append(sink.messages, msg)
+	return nil
+}
+
+func (sink *memorySink) Close() error {
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	sink := &memorySink{}
+	logger := New(sink)
+	logger.SetLevel(DEBUG)
+	logger.Named("radio").Debug("packet received")
+	logger.Trace("dropped")
+	logger.Close()
+	logger.Info("logged after close")
+	if len(sink.messages) != 3 {
+		t.Fatal("Logger should write messages at or above its level until closed: got ", len(sink.messages), " messages")
+	}
+	if sink.messages[1].Payload() != "packet received" || sink.messages[1].Fields()["subsystem"] != "radio" {
+		t.Error("Named should tag messages with the subsystem name: got ", sink.messages[1].Fields())
+	}
+}
+
+func TestSetLevels(t *testing.T) {
+	logger := New()
+	defer logger.Close()
+	if err := logger.SetLevels("debug,homie=trace, radio=warn"); err != nil {
+		t.Fatal("SetLevels should accept a valid level list: got ", err)
+	}
+	if logger.core.levelOf("homie") != TRACE || logger.core.levelOf("radio") != WARN || logger.core.levelOf("config") != DEBUG {
+		t.Error("SetLevels should set subsystem levels, and the global level for other subsystems")
+	}
+	if logger.Levels() != "debug,homie=trace,radio=warn" {
+		t.Error("Levels should describe the global and subsystem levels: got ", logger.Levels())
+	}
+	if err := logger.SetLevels("info,homie=verbose"); err == nil {
+		t.Error("SetLevels should reject unknown severities")
+	}
+	if logger.core.levelOf("") != DEBUG {
+		t.Error("SetLevels should not apply anything when an entry is invalid")
+	}
+	if err := logger.ReplaceLevels("warn,radio=info"); err != nil || logger.core.levelOf("homie") != WARN || logger.core.levelOf("radio") != INFO {
+		t.Error("ReplaceLevels should reset subsystems missing from the list: got ", logger.Levels(), err)
+	}
+	if err := logger.ReplaceLevels("error,homie=verbose,radio=trace"); err == nil || logger.Levels() != "warn,radio=info" {
+		t.Error("ReplaceLevels should not apply anything when an entry is invalid: got ", logger.Levels(), err)
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	logger := New()
+	defer logger.Close()
+	logger.SetLevel(TRACE)
+	logger.SetSubsystemLevel("radio", ERROR)
+	logger.IncreaseVerbosity()
+	if logger.core.levelOf("") != TRACE || logger.core.levelOf("radio") != WARN {
+		t.Error("IncreaseVerbosity should lower every level, down to TRACE: got ", logger.Levels())
+	}
+	logger.DecreaseVerbosity()
+	if logger.core.levelOf("") != DEBUG || logger.core.levelOf("radio") != ERROR {
+		t.Error("DecreaseVerbosity should raise every level: got ", logger.Levels())
+	}
+}
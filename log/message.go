@@ -3,6 +3,7 @@ package log
 import (
 	"errors"
 	"github.com/google/uuid"
+	"strings"
 	"time"
 )
 
@@ -28,11 +29,23 @@ func Severity(severity int) string {
 	return severities[severity]
 }
 
+// ParseSeverity returns the severity matching the given name, such as "debug"
+// or "WARN".
+func ParseSeverity(name string) (int, error) {
+	for severity, severityName := range severities {
+		if strings.EqualFold(strings.TrimSpace(severityName), strings.TrimSpace(name)) {
+			return severity, nil
+		}
+	}
+	return 0, errors.New("unknown severity: " + name)
+}
+
 type Message interface {
 	Uuid() uuid.UUID
 	Payload() string
 	Severity() int
 	CreationDate() time.Time
+	Fields() Fields
 	Close()
 }
 
@@ -41,13 +54,20 @@ type message struct {
 	creationDate time.Time
 	payload      string
 	severity     int
+	fields       Fields
+	enqueued     time.Time
+	stats        *counters
 }
 
 func NewMessage(severity int, payload string) (Message, error) {
-	if severity > FATAL {
+	return NewMessageWithFields(severity, payload, nil)
+}
+
+func NewMessageWithFields(severity int, payload string, fields Fields) (Message, error) {
+	if severity < TRACE || severity > FATAL {
 		return nil, errors.New("unknown severity")
 	} else {
-		return &message{uuid: uuid.New(), creationDate: time.Now(), payload: payload, severity: severity}, nil
+		return &message{uuid: uuid.New(), creationDate: time.Now(), payload: payload, severity: severity, fields: fields}, nil
 	}
 }
 func (message *message) CreationDate() time.Time {
@@ -62,7 +82,17 @@ func (message *message) Uuid() uuid.UUID {
 func (message *message) Severity() int {
 	return message.severity
 }
+func (message *message) Fields() Fields {
+	return message.fields
+}
+
+// Close records the time the message spent in the queue, and counts it in
+// the statistics of its logger. It must NOT produce a log, as it is called by
+// the log routine.
 func (message *message) Close() {
-	// Use this to send metrics about message consumption time,
-	// but do NOT produce a log, as this is called by the log routine
+	if message.stats == nil {
+		return
+	}
+	message.stats.record(message.severity, time.Since(message.enqueued))
+	message.stats = nil
 }
@@ -0,0 +1,86 @@
+package log
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Block waits for room in the queue.
+	Block = iota
+	// DropNewest drops messages when the queue is full.
+	DropNewest
+	// DropBelow drops messages below a severity when the queue is full, and
+	// waits for room for the others.
+	DropBelow
+)
+
+// OverflowPolicy tells what happens to messages logged while the queue is
+// full.
+type OverflowPolicy struct {
+	Mode     int
+	Severity int
+}
+
+// ParseOverflowPolicy returns the policy matching the given name: "block",
+// "drop_newest" or "drop_below". severity is only used by "drop_below".
+func ParseOverflowPolicy(name string, severity string) (OverflowPolicy, error) {
+	switch name {
+	case "", "block":
+		return OverflowPolicy{Mode: Block}, nil
+	case "drop_newest":
+		return OverflowPolicy{Mode: DropNewest}, nil
+	case "drop_below":
+		parsed, err := ParseSeverity(severity)
+		if err != nil {
+			return OverflowPolicy{}, err
+		}
+		return OverflowPolicy{Mode: DropBelow, Severity: parsed}, nil
+	default:
+		return OverflowPolicy{}, errors.New("unknown overflow policy: " + name)
+	}
+}
+
+func (logger *Logger) SetOverflowPolicy(policy OverflowPolicy) {
+	logger.core.policy.Store(policy)
+}
+
+// Dropped returns the number of messages dropped because the queue was full.
+func (logger *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&logger.core.dropped)
+}
+
+// enqueue submits msg to the log routine according to the overflow policy.
+// It must be called with closedLock held.
+func (c *core) enqueue(msg Message) {
+	policy := c.policy.Load().(OverflowPolicy)
+	if tracked, ok := msg.(*message); ok {
+		tracked.enqueued = time.Now()
+		tracked.stats = &c.stats
+	}
+	if policy.Mode == Block || (policy.Mode == DropBelow && msg.Severity() >= policy.Severity) {
+		c.queue <- msg
+		return
+	}
+	select {
+	case c.queue <- msg:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		atomic.AddUint64(&c.pendingDrops, 1)
+	}
+}
+
+// reportDrops writes a summary of the dropped messages once the queue is
+// drained. It is called by the log routine.
+func (c *core) reportDrops() {
+	if len(c.queue) > 0 {
+		return
+	}
+	if dropped := atomic.SwapUint64(&c.pendingDrops, 0); dropped > 0 {
+		msg, _ := NewMessage(WARN, strconv.FormatUint(dropped, 10)+" log messages dropped: log queue was full")
+		c.writeSinks(msg)
+		c.forwardRemote(msg)
+	}
+}
@@ -0,0 +1,51 @@
+package log
+
+import (
+	"strings"
+	"testing"
+)
+
+// gatedSink blocks writes until its gate is closed, to simulate a stalled
+// output.
+type gatedSink struct {
+	memorySink
+	gate chan bool
+}
+
+func (sink *gatedSink) Write(msg Message) error {
+	<-sink.gate
+	return sink.memorySink.Write(msg)
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	sink := &gatedSink{gate: make(chan bool)}
+	logger := New(sink)
+	logger.SetOverflowPolicy(OverflowPolicy{Mode: DropNewest})
+	for i := 0; i < queueSize*2; i++ {
+		logger.Info("message ", i)
+	}
+	if logger.Dropped() == 0 {
+		t.Error("DropNewest should drop messages when the queue is full")
+	}
+	close(sink.gate)
+	logger.Close()
+	found := false
+	for _, msg := range sink.messages {
+		if strings.HasSuffix(msg.Payload(), "log messages dropped: log queue was full") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the log routine should report dropped messages once the queue is drained")
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	policy, err := ParseOverflowPolicy("drop_below", "warn")
+	if err != nil || policy.Mode != DropBelow || policy.Severity != WARN {
+		t.Error("ParseOverflowPolicy should parse drop_below policies: got ", policy, err)
+	}
+	if _, err := ParseOverflowPolicy("drop_oldest", ""); err == nil {
+		t.Error("ParseOverflowPolicy should reject unknown policies")
+	}
+}
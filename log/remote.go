@@ -0,0 +1,109 @@
+package log
+
+import (
+	"strconv"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing rate events per second, with bursts
+// of up to rate events.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (limiter *rateLimiter) allow(now time.Time) bool {
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.rate {
+		limiter.tokens = limiter.rate
+	}
+	limiter.last = now
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens -= 1
+	return true
+}
+
+type remoteSink struct {
+	severity int
+	limiter  *rateLimiter
+	dropped  int
+	queue    chan Message
+	publish  func(msg Message)
+}
+
+// SetRemote forwards messages at or above severity to publish, at most rate
+// messages per second. Messages over the rate are dropped, and a summary is
+// forwarded once the rate allows it again.
+// publish is called from a dedicated goroutine. It must not log itself, or
+// it would feed its own output back into the remote sink.
+func (logger *Logger) SetRemote(severity int, rate int, publish func(msg Message)) {
+	if rate <= 0 {
+		rate = 1
+	}
+	logger.StopRemote()
+	sink := &remoteSink{
+		severity: severity,
+		limiter:  newRateLimiter(rate),
+		queue:    make(chan Message, rate),
+		publish:  publish,
+	}
+	go sink.loop()
+	logger.core.remoteLock.Lock()
+	logger.core.remote = sink
+	logger.core.remoteLock.Unlock()
+}
+
+// StopRemote stops forwarding messages to the remote sink, if any.
+func (logger *Logger) StopRemote() {
+	logger.core.remoteLock.Lock()
+	defer logger.core.remoteLock.Unlock()
+	if logger.core.remote != nil {
+		close(logger.core.remote.queue)
+		logger.core.remote = nil
+	}
+}
+
+// forwardRemote is called by the log routine for each emitted message.
+func (c *core) forwardRemote(msg Message) {
+	c.remoteLock.Lock()
+	defer c.remoteLock.Unlock()
+	remote := c.remote
+	if remote == nil || msg.Severity() < remote.severity {
+		return
+	}
+	if !remote.limiter.allow(time.Now()) {
+		remote.dropped += 1
+		return
+	}
+	if remote.dropped > 0 {
+		summary, _ := NewMessage(WARN, strconv.Itoa(remote.dropped)+" log messages were not forwarded: rate limit exceeded")
+		if remote.enqueue(summary) {
+			remote.dropped = 0
+		}
+	}
+	if !remote.enqueue(msg) {
+		remote.dropped += 1
+	}
+}
+
+func (sink *remoteSink) enqueue(msg Message) bool {
+	select {
+	case sink.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sink *remoteSink) loop() {
+	for msg := range sink.queue {
+		sink.publish(msg)
+	}
+}
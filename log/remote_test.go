@@ -0,0 +1,30 @@
+package log
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	limiter := &rateLimiter{rate: 2, tokens: 2, last: start}
+	if !limiter.allow(start) || !limiter.allow(start) {
+		t.Error("rateLimiter should allow a burst of rate events")
+	}
+	if limiter.allow(start) {
+		t.Error("rateLimiter should deny events over the rate")
+	}
+	if !limiter.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("rateLimiter should allow events once tokens are refilled")
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	severity, err := ParseSeverity("warn")
+	if err != nil || severity != WARN {
+		t.Error("ParseSeverity should parse lowercase severity names: got ", severity, err)
+	}
+	if _, err := ParseSeverity("verbose"); err == nil {
+		t.Error("ParseSeverity should reject unknown severities")
+	}
+}
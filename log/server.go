@@ -1,38 +1,43 @@
 package log
 
-import (
-	"fmt"
-	"time"
-)
+import "time"
 
-var logChan chan Message
-var doneChan chan bool
-
-func init() {
-	logChan = make(chan Message, 50)
-	doneChan = make(chan bool, 1)
-	go loop()
-}
-
-func loop() {
-	Info("log subsystem started")
-	run := true
-	for run {
+func (logger *Logger) loop() {
+	c := logger.core
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
 		select {
-		case msg, chanOpen := <-logChan:
-			if !chanOpen {
+		case msg, ok := <-c.queue:
+			if !ok {
+				c.writeSummaries(c.throttle.flush(time.Now(), true))
+				c.reportDrops()
 				msg, _ := NewMessage(INFO, "log subsystem flushed and closed")
-				printLog(msg)
-				doneChan <- true
+				c.writeSinks(msg)
+				c.done <- true
 				return
-			} else {
-				printLog(msg)
-				msg.Close()
 			}
+			c.writeSinks(msg)
+			c.forwardRemote(msg)
+			msg.Close()
+			c.reportDrops()
+		case now := <-ticker.C:
+			c.writeSummaries(c.throttle.flush(now, false))
 		}
 	}
 }
 
-func printLog(msg Message) {
-	fmt.Printf("%s [%s] %s\n", msg.CreationDate().Format(time.RFC3339), Severity(msg.Severity()), msg.Payload())
+// writeSummaries is called by the log routine to write the summaries of
+// suppressed messages. They are written directly, as the routine cannot wait
+// for room in its own queue.
+func (c *core) writeSummaries(summaries []Message) {
+	for _, msg := range summaries {
+		c.writeSinks(msg)
+		c.forwardRemote(msg)
+	}
+}
+
+// Format renders a message as a single text log line.
+func Format(msg Message) string {
+	return TextEncoder.Encode(msg)
 }
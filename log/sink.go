@@ -0,0 +1,77 @@
+package log
+
+import (
+	"fmt"
+	"os"
+)
+
+// Sink is a destination for log messages.
+type Sink interface {
+	Write(msg Message) error
+	Close() error
+}
+
+type stdoutSink struct {
+	encoder Encoder
+}
+
+// NewStdoutSink prints messages on stdout.
+func NewStdoutSink(encoder Encoder) Sink {
+	return &stdoutSink{encoder: encoder}
+}
+
+func (sink *stdoutSink) Write(msg Message) error {
+	_, err := fmt.Fprintln(os.Stdout, sink.encoder.Encode(msg))
+	return err
+}
+
+func (sink *stdoutSink) Close() error {
+	return nil
+}
+
+type filteredSink struct {
+	Sink
+	severity int
+}
+
+// WithLevel wraps sink so that it only receives messages at or above
+// severity.
+func WithLevel(sink Sink, severity int) Sink {
+	return &filteredSink{Sink: sink, severity: severity}
+}
+
+func (sink *filteredSink) Write(msg Message) error {
+	if msg.Severity() < sink.severity {
+		return nil
+	}
+	return sink.Sink.Write(msg)
+}
+
+// SetSinks replaces the sinks messages are written to, and closes the
+// previous ones.
+func (logger *Logger) SetSinks(sinks ...Sink) {
+	c := logger.core
+	c.sinksLock.Lock()
+	previous := c.sinks
+	c.sinks = sinks
+	c.sinksLock.Unlock()
+	for _, sink := range previous {
+		if err := sink.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "could not close log sink:", err)
+		}
+	}
+}
+
+// writeSinks is called by the log routine for each message, which is also
+// kept in the history. Sink errors are reported on stderr, as logging them
+// would loop.
+func (c *core) writeSinks(msg Message) {
+	c.history.add(msg)
+	c.sinksLock.RLock()
+	defer c.sinksLock.RUnlock()
+	for _, sink := range c.sinks {
+		if err := sink.Write(msg); err != nil {
+			fmt.Fprintln(os.Stderr, "could not write log message:", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package log
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Statistics describes the activity of a logger since it was created.
+type Statistics struct {
+	// Emitted counts the messages written by the log routine, per severity
+	// name.
+	Emitted map[string]uint64
+	// Dropped counts the messages dropped because the queue was full.
+	Dropped uint64
+	// Suppressed counts the messages suppressed by deduplication or rate
+	// limits.
+	Suppressed    uint64
+	QueueDepth    int
+	QueueCapacity int
+	// AverageLatency and MaxLatency measure the time between a message being
+	// enqueued and being emitted.
+	AverageLatency time.Duration
+	MaxLatency     time.Duration
+}
+
+// Map renders the statistics as strings, keyed by name, for example to be
+// published as homie $stats.
+func (stats Statistics) Map() map[string]string {
+	values := map[string]string{
+		"dropped":            strconv.FormatUint(stats.Dropped, 10),
+		"suppressed":         strconv.FormatUint(stats.Suppressed, 10),
+		"queue_depth":        strconv.Itoa(stats.QueueDepth),
+		"queue_capacity":     strconv.Itoa(stats.QueueCapacity),
+		"latency_average_us": strconv.FormatInt(stats.AverageLatency.Nanoseconds()/1000, 10),
+		"latency_max_us":     strconv.FormatInt(stats.MaxLatency.Nanoseconds()/1000, 10),
+	}
+	for severity, count := range stats.Emitted {
+		values["emitted_"+severity] = strconv.FormatUint(count, 10)
+	}
+	return values
+}
+
+// counters is fed by Message.Close, from the log routine.
+type counters struct {
+	lock         sync.Mutex
+	emitted      [FATAL + 1]uint64
+	count        uint64
+	totalLatency time.Duration
+	maxLatency   time.Duration
+	suppressed   uint64
+}
+
+func (stats *counters) record(severity int, latency time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.emitted[severity] += 1
+	stats.count += 1
+	stats.totalLatency += latency
+	if latency > stats.maxLatency {
+		stats.maxLatency = latency
+	}
+}
+
+func (stats *counters) suppress() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.suppressed += 1
+}
+
+func (stats *counters) suppressedCount() uint64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return stats.suppressed
+}
+
+// Stats returns the statistics of the logger, shared with every logger
+// derived from it with Named.
+func (logger *Logger) Stats() Statistics {
+	c := logger.core
+	result := Statistics{
+		Emitted:       map[string]uint64{},
+		Dropped:       logger.Dropped(),
+		QueueDepth:    len(c.queue),
+		QueueCapacity: cap(c.queue),
+	}
+	c.stats.lock.Lock()
+	defer c.stats.lock.Unlock()
+	for severity := TRACE; severity <= FATAL; severity++ {
+		result.Emitted[levelName(severity)] = c.stats.emitted[severity]
+	}
+	if c.stats.count > 0 {
+		result.AverageLatency = c.stats.totalLatency / time.Duration(c.stats.count)
+	}
+	result.MaxLatency = c.stats.maxLatency
+	result.Suppressed = c.stats.suppressed
+	return result
+}
@@ -0,0 +1,25 @@
+package log
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	logger := New(&memorySink{})
+	logger.SetLevel(DEBUG)
+	logger.Debug("first")
+	logger.Warn("second")
+	logger.Warn("third")
+	logger.Close()
+	stats := logger.Stats()
+	if stats.Emitted["info"] != 1 || stats.Emitted["debug"] != 1 || stats.Emitted["warn"] != 2 {
+		t.Error("Stats should count emitted messages per severity: got ", stats.Emitted)
+	}
+	if stats.QueueDepth != 0 || stats.QueueCapacity != queueSize {
+		t.Error("Stats should report the queue depth and capacity: got ", stats.QueueDepth, stats.QueueCapacity)
+	}
+	if stats.MaxLatency < stats.AverageLatency {
+		t.Error("Stats max latency should not be lower than the average: got ", stats.MaxLatency, stats.AverageLatency)
+	}
+	if stats.Map()["emitted_warn"] != "2" {
+		t.Error("Stats.Map should render the counters: got ", stats.Map())
+	}
+}
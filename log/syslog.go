@@ -0,0 +1,85 @@
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	syslogSocket   = "/dev/log"
+	syslogFacility = 3 // daemon
+)
+
+// syslogSeverities maps severities to syslog and journald priorities.
+var syslogSeverities = [...]int{
+	7, // TRACE: debug
+	7, // DEBUG: debug
+	6, // INFO: info
+	4, // WARN: warning
+	3, // ERROR: err
+	2, // FATAL: crit
+}
+
+type syslogSink struct {
+	lock    sync.Mutex
+	tag     string
+	encoder Encoder
+	conn    net.Conn
+}
+
+// NewSyslogSink sends messages to the local syslog daemon, through its unix
+// socket. The timestamp and the severity are only sent in the syslog header.
+func NewSyslogSink(tag string, encoder Encoder) Sink {
+	return &syslogSink{tag: tag, encoder: encoder}
+}
+
+func (sink *syslogSink) connect() error {
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		sink.conn, err = net.Dial(network, syslogSocket)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (sink *syslogSink) Write(msg Message) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	line := fmt.Sprintf("<%d>%s %s[%d]: %s\n",
+		syslogFacility*8+syslogSeverities[msg.Severity()],
+		msg.CreationDate().Format(time.Stamp),
+		sink.tag, os.Getpid(),
+		encodeBody(sink.encoder, msg))
+	if sink.conn == nil {
+		if err := sink.connect(); err != nil {
+			return err
+		}
+	}
+	if _, err := sink.conn.Write([]byte(line)); err != nil {
+		// the syslog daemon may have been restarted: reconnect once
+		sink.conn.Close()
+		sink.conn = nil
+		if err := sink.connect(); err != nil {
+			return err
+		}
+		_, err = sink.conn.Write([]byte(line))
+		return err
+	}
+	return nil
+}
+
+func (sink *syslogSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.conn == nil {
+		return nil
+	}
+	err := sink.conn.Close()
+	sink.conn = nil
+	return err
+}
@@ -0,0 +1,165 @@
+package log
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repeat tracks the occurrences of a message during the deduplication
+// window.
+type repeat struct {
+	msg   Message
+	since time.Time
+	count int
+}
+
+func (r *repeat) summary() Message {
+	fields := Entry{fields: r.msg.Fields()}.WithField("repeated", r.count).fields
+	msg, _ := NewMessageWithFields(r.msg.Severity(), r.msg.Payload()+" (repeated "+strconv.Itoa(r.count)+" times)", fields)
+	return msg
+}
+
+// throttle collapses identical messages, and limits the rate of messages
+// per subsystem, before they reach the queue.
+type throttle struct {
+	lock     sync.Mutex
+	window   time.Duration
+	repeats  map[string]*repeat
+	limits   map[string]int
+	limiters map[string]*rateLimiter
+	limited  map[string]int
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		repeats:  map[string]*repeat{},
+		limits:   map[string]int{},
+		limiters: map[string]*rateLimiter{},
+		limited:  map[string]int{},
+	}
+}
+
+// SetDeduplication collapses identical messages logged during window into
+// the first one, followed by a summary with the repeat count. A zero window
+// disables deduplication.
+func (logger *Logger) SetDeduplication(window time.Duration) {
+	t := logger.core.throttle
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.window = window
+}
+
+// SetRateLimits replaces the rate limits, in messages per second, keyed by
+// subsystem name. The default logger uses the "" key. Messages over the rate
+// are suppressed, and a summary is logged once the rate allows it again.
+func (logger *Logger) SetRateLimits(limits map[string]int) {
+	t := logger.core.throttle
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.limits = map[string]int{}
+	t.limiters = map[string]*rateLimiter{}
+	for key, rate := range limits {
+		if rate > 0 {
+			t.limits[key] = rate
+		}
+	}
+}
+
+// Suppressed returns the number of messages suppressed by deduplication or
+// rate limits.
+func (logger *Logger) Suppressed() uint64 {
+	return logger.core.stats.suppressedCount()
+}
+
+// dedupKey identifies identical messages. The correlation id is ignored, as
+// it differs for each occurrence of a message.
+func dedupKey(msg Message) string {
+	builder := &strings.Builder{}
+	builder.WriteString(strconv.Itoa(msg.Severity()))
+	builder.WriteString(" ")
+	builder.WriteString(msg.Payload())
+	fields := Fields{}
+	for key, value := range msg.Fields() {
+		if key != CorrelationKey {
+			fields[key] = value
+		}
+	}
+	appendFields(builder, fields)
+	return builder.String()
+}
+
+// admit tells whether msg, logged by the named subsystem, should be
+// enqueued. It also returns summaries of the previously suppressed messages,
+// to be enqueued before msg.
+func (t *throttle) admit(msg Message, name string, now time.Time, stats *counters) ([]Message, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	summaries := []Message{}
+	key := dedupKey(msg)
+	if r, found := t.repeats[key]; found {
+		if now.Sub(r.since) < t.window {
+			r.count += 1
+			stats.suppress()
+			return summaries, false
+		}
+		if r.count > 0 {
+			summaries = append(summaries, r.summary())
+		}
+		delete(t.repeats, key)
+	}
+	if rate, found := t.limits[name]; found {
+		limiter, found := t.limiters[name]
+		if !found {
+			limiter = newRateLimiter(rate)
+			t.limiters[name] = limiter
+		}
+		if !limiter.allow(now) {
+			t.limited[name] += 1
+			stats.suppress()
+			return summaries, false
+		}
+		if t.limited[name] > 0 {
+			summaries = append(summaries, limitedSummary(name, t.limited[name]))
+			delete(t.limited, name)
+		}
+	}
+	if t.window > 0 {
+		t.repeats[key] = &repeat{msg: msg, since: now}
+	}
+	return summaries, true
+}
+
+// flush returns summaries for the repeats whose window is over, and for the
+// rate limited subsystems whose rate allows it again. Everything is flushed
+// when all is set.
+func (t *throttle) flush(now time.Time, all bool) []Message {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	summaries := []Message{}
+	for key, r := range t.repeats {
+		if all || now.Sub(r.since) >= t.window {
+			if r.count > 0 {
+				summaries = append(summaries, r.summary())
+			}
+			delete(t.repeats, key)
+		}
+	}
+	for name, count := range t.limited {
+		if limiter, found := t.limiters[name]; all || !found || limiter.allow(now) {
+			summaries = append(summaries, limitedSummary(name, count))
+			delete(t.limited, name)
+		}
+	}
+	return summaries
+}
+
+func limitedSummary(name string, count int) Message {
+	source := "log messages"
+	if name != "" {
+		source = "log messages from " + name
+	}
+	msg, _ := NewMessage(WARN, strconv.Itoa(count)+" "+source+" suppressed: rate limit exceeded")
+	return msg
+}
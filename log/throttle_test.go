@@ -0,0 +1,54 @@
+package log
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplication(t *testing.T) {
+	sink := &memorySink{}
+	logger := New(sink)
+	logger.SetDeduplication(time.Minute)
+	for i := 0; i < 5; i++ {
+		logger.Named("radio").WithField(CorrelationKey, i).Error("binary.Read failed: unexpected EOF")
+	}
+	logger.Named("radio").Error("another error")
+	logger.Close()
+	if len(sink.messages) != 5 {
+		t.Fatal("identical messages should be collapsed within the window: got ", len(sink.messages), " messages")
+	}
+	summary := sink.messages[3]
+	if summary.Fields()["repeated"] != 4 || summary.Fields()["subsystem"] != "radio" {
+		t.Error("a summary with the repeat count should be written when closing: got ", summary.Payload(), summary.Fields())
+	}
+	if logger.Suppressed() != 4 {
+		t.Error("Suppressed should count collapsed messages: got ", logger.Suppressed())
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	sink := &memorySink{}
+	logger := New(sink)
+	logger.SetRateLimits(map[string]int{"radio": 2})
+	for i := 0; i < 10; i++ {
+		logger.Named("radio").Info("packet ", i)
+		logger.Named("homie").Info("publication ", i)
+	}
+	logger.Close()
+	radio, homie, summaries := 0, 0, 0
+	for _, msg := range sink.messages {
+		switch msg.Fields()["subsystem"] {
+		case "radio":
+			radio += 1
+		case "homie":
+			homie += 1
+		default:
+			if msg.Payload() == "8 log messages from radio suppressed: rate limit exceeded" {
+				summaries += 1
+			}
+		}
+	}
+	if radio != 2 || homie != 10 || summaries != 1 {
+		t.Error("rate limits should only apply to their subsystem: got ", radio, " radio, ", homie, " homie and ", summaries, " summaries")
+	}
+}
@@ -0,0 +1,127 @@
+package ota
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// pendingUpdate is persisted next to the executable while an update is not
+// confirmed yet.
+type pendingUpdate struct {
+	Version         string `json:"version"`
+	PreviousVersion string `json:"previous_version"`
+	Boots           int    `json:"boots"`
+	RolledBack      bool   `json:"rolled_back,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+func downloadPath(executable string) string {
+	return executable + ".download"
+}
+
+func previousPath(executable string) string {
+	return executable + ".previous"
+}
+
+func pendingPath(executable string) string {
+	return executable + ".ota"
+}
+
+func readPendingUpdate(executable string) (*pendingUpdate, error) {
+	buf, err := ioutil.ReadFile(pendingPath(executable))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pending := &pendingUpdate{}
+	return pending, json.Unmarshal(buf, pending)
+}
+
+func writePendingUpdate(executable string, pending *pendingUpdate) error {
+	buf, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pendingPath(executable), buf, 0600)
+}
+
+func removePendingUpdate(executable string) error {
+	err := os.Remove(pendingPath(executable))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func checksum(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// install keeps a copy of the executable for rollbacks, and atomically
+// replaces it with the verified download.
+func install(executable string) error {
+	if err := os.Chmod(downloadPath(executable), 0755); err != nil {
+		return err
+	}
+	os.Remove(previousPath(executable))
+	if err := os.Link(executable, previousPath(executable)); err != nil {
+		if err := copyFile(executable, previousPath(executable)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(downloadPath(executable), executable)
+}
+
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
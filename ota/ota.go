@@ -0,0 +1,500 @@
+package ota
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/jbonachera/weathercontroller/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = log.Named("ota")
+
+/*
+ An update is announced with a manifest on $implementation/ota/set:
+ {
+   "version": "1.2.0",
+   "size": 8388608,
+   "sha256": "hex encoded sha256 of the binary",
+   "signature": "base64 encoded ed25519 signature of the version and the sha256",
+   "url": "http://192.0.2.10/weathercontroller-1.2.0"
+ }
+ The signed message is the version, a newline and the hex encoded sha256, so
+ that the manifest of an older version cannot be replayed. Only versions
+ newer than the running one are installed. The signature is checked before
+ anything is downloaded, and the size must not exceed maxSize.
+ When url is empty, the binary is expected in order on
+ $implementation/ota/chunk/set:
+ {
+   "offset": 0,
+   "data": "base64 encoded chunk"
+ }
+*/
+
+const (
+	StateIdle        = "idle"
+	StateDownloading = "downloading"
+	StateVerifying   = "verifying"
+	StateInstalling  = "installing"
+	StateRestarting  = "restarting"
+	StateSucceeded   = "succeeded"
+	StateFailed      = "failed"
+	StateRolledBack  = "rolled_back"
+
+	downloadTimeout = 10 * time.Minute
+	maxBoots        = 1
+	// maxSize bounds the size announced by manifests, in bytes.
+	maxSize = 64 * 1024 * 1024
+	// inactivityTimeout aborts an update receiving no data, so that a
+	// stalled download does not block the next updates.
+	inactivityTimeout = 2 * time.Minute
+)
+
+type Manifest struct {
+	Version   string `json:"version"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	Url       string `json:"url,omitempty"`
+}
+
+type Chunk struct {
+	Offset int64  `json:"offset"`
+	Data   string `json:"data"`
+}
+
+type Status struct {
+	State    string `json:"state"`
+	Version  string `json:"version,omitempty"`
+	Progress int    `json:"progress"`
+	Error    string `json:"error,omitempty"`
+}
+
+type Updater interface {
+	Update(manifest string) error
+	Chunk(chunk string) error
+	Reconfigure(publicKey string)
+	Pending() bool
+	Crashed() bool
+	Confirm()
+	Rollback(reason error) error
+}
+
+type updater struct {
+	lock       sync.Mutex
+	version    string
+	publicKey  string
+	executable string
+	err        error
+	pending    *pendingUpdate
+	manifest   *Manifest
+	download   *os.File
+	received   int64
+	activity   time.Time
+	timeout    time.Duration
+	progress   int
+	publish    func(status string)
+	restart    func(executable string)
+}
+
+// NewUpdater creates an updater replacing the running executable. publish is
+// called with the JSON encoded Status each time the update progresses, and
+// restart is called with the path of the executable to run once it has been
+// replaced.
+func NewUpdater(version string, publicKey string, publish func(status string), restart func(executable string)) Updater {
+	u := &updater{version: version, publicKey: publicKey, publish: publish, restart: restart, timeout: inactivityTimeout}
+	u.executable, u.err = os.Executable()
+	if u.err == nil {
+		u.executable, u.err = filepath.EvalSymlinks(u.executable)
+	}
+	if u.err != nil {
+		logger.Error("OTA updates are disabled: ", u.err)
+		return u
+	}
+	pending, err := readPendingUpdate(u.executable)
+	if err != nil {
+		logger.Error("could not read pending update state: ", err)
+	} else if pending != nil {
+		u.pending = pending
+		if !pending.RolledBack {
+			pending.Boots += 1
+			if err := writePendingUpdate(u.executable, pending); err != nil {
+				logger.Error("could not save pending update state: ", err)
+			}
+		}
+	}
+	return u
+}
+
+func (u *updater) Reconfigure(publicKey string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.publicKey = publicKey
+}
+
+// Pending returns true when the running executable was just installed and has
+// not been confirmed yet.
+func (u *updater) Pending() bool {
+	return u.pending != nil && !u.pending.RolledBack
+}
+
+// Crashed returns true when the running executable was installed by an update,
+// but a previous run of it exited before being confirmed.
+func (u *updater) Crashed() bool {
+	return u.Pending() && u.pending.Boots > maxBoots
+}
+
+// Confirm reports the outcome of the last update, once the running
+// executable has reached the MQTT server.
+func (u *updater) Confirm() {
+	if u.pending == nil {
+		u.publishStatus(Status{State: StateIdle, Version: u.version})
+		return
+	}
+	if u.pending.RolledBack {
+		logger.Warn("update to version ", u.pending.Version, " was rolled back: ", u.pending.Error)
+		u.publishStatus(Status{State: StateRolledBack, Version: u.pending.Version, Error: u.pending.Error})
+	} else {
+		logger.Info("update to version ", u.version, " succeeded")
+		u.publishStatus(Status{State: StateSucceeded, Version: u.version, Progress: 100})
+	}
+	if err := removePendingUpdate(u.executable); err != nil {
+		logger.Error("could not remove pending update state: ", err)
+	}
+	u.pending = nil
+}
+
+// Rollback restores the executable replaced by the last update, and restarts
+// it.
+func (u *updater) Rollback(reason error) error {
+	if !u.Pending() {
+		return errors.New("no update to roll back")
+	}
+	logger.Error("rolling back update to version ", u.pending.Version, ": ", reason)
+	if err := os.Rename(previousPath(u.executable), u.executable); err != nil {
+		logger.Error("could not roll back update: ", err)
+		return err
+	}
+	u.pending.RolledBack = true
+	u.pending.Error = reason.Error()
+	if err := writePendingUpdate(u.executable, u.pending); err != nil {
+		logger.Error("could not save pending update state: ", err)
+	}
+	u.restart(u.executable)
+	return nil
+}
+
+// Update starts an update from the given JSON manifest.
+func (u *updater) Update(payload string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.err != nil {
+		return u.err
+	}
+	if u.manifest != nil {
+		return errors.New("an update to version " + u.manifest.Version + " is already in progress")
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal([]byte(payload), manifest); err != nil {
+		return u.fail(errors.New("invalid update manifest: " + err.Error()))
+	}
+	if manifest.Version == "" || manifest.Size <= 0 || manifest.Sha256 == "" || manifest.Signature == "" {
+		return u.fail(errors.New("update manifest must provide a version, a size, a sha256 and a signature"))
+	}
+	if manifest.Size > maxSize {
+		return u.fail(errors.New("update size " + strconv.FormatInt(manifest.Size, 10) + " exceeds the maximum of " + strconv.Itoa(maxSize) + " bytes"))
+	}
+	if u.publicKey == "" {
+		return u.fail(errors.New("no public key is configured to verify updates"))
+	}
+	if err := verifyManifest(manifest, u.publicKey); err != nil {
+		return u.fail(err)
+	}
+	if err := checkNewer(manifest.Version, u.version); err != nil {
+		return u.fail(err)
+	}
+	download, err := os.OpenFile(downloadPath(u.executable), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0700)
+	if err != nil {
+		return u.fail(err)
+	}
+	logger.Info("starting update to version ", manifest.Version)
+	u.manifest = manifest
+	u.download = download
+	u.received = 0
+	u.progress = 0
+	u.activity = time.Now()
+	u.publishStatus(Status{State: StateDownloading, Version: manifest.Version})
+	time.AfterFunc(u.timeout, func() { u.watch(manifest) })
+	if manifest.Url != "" {
+		go u.fetch(manifest)
+	}
+	return nil
+}
+
+// watch aborts the update of manifest once it has received no data for
+// the inactivity timeout.
+func (u *updater) watch(manifest *Manifest) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.manifest != manifest || u.received == manifest.Size {
+		return
+	}
+	if idle := time.Since(u.activity); idle < u.timeout {
+		time.AfterFunc(u.timeout-idle, func() { u.watch(manifest) })
+		return
+	}
+	u.abort(errors.New("update stalled: no data received for " + u.timeout.String()))
+}
+
+// Chunk writes a JSON encoded chunk of the binary announced by the last
+// manifest. Chunks must be sent in order, and duplicated chunks are ignored.
+func (u *updater) Chunk(payload string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.manifest == nil || u.manifest.Url != "" {
+		return errors.New("no chunked update in progress")
+	}
+	chunk := Chunk{}
+	if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+		return u.abort(errors.New("invalid update chunk: " + err.Error()))
+	}
+	if u.received == u.manifest.Size {
+		return errors.New("update is already complete")
+	}
+	if chunk.Offset < u.received {
+		logger.Debug("ignoring duplicated update chunk at offset ", chunk.Offset)
+		return nil
+	}
+	if chunk.Offset > u.received {
+		return u.abort(errors.New("missing update chunk at offset " + strconv.FormatInt(u.received, 10)))
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		return u.abort(errors.New("invalid update chunk encoding: " + err.Error()))
+	}
+	if _, err := u.write(data); err != nil {
+		return u.abort(err)
+	}
+	if u.received == u.manifest.Size {
+		go u.finish(u.manifest)
+	}
+	return nil
+}
+
+// write appends data to the download, and reports progress every 10%.
+func (u *updater) write(data []byte) (int, error) {
+	if u.received+int64(len(data)) > u.manifest.Size {
+		return 0, errors.New("update is larger than announced")
+	}
+	n, err := u.download.Write(data)
+	u.received += int64(n)
+	u.activity = time.Now()
+	if err != nil {
+		return n, err
+	}
+	progress := int(u.received * 100 / u.manifest.Size)
+	if progress/10 > u.progress/10 {
+		u.progress = progress
+		u.publishStatus(Status{State: StateDownloading, Version: u.manifest.Version, Progress: progress})
+	}
+	return n, nil
+}
+
+// lockedWriter writes the download of manifest, until it is aborted.
+type lockedWriter struct {
+	u        *updater
+	manifest *Manifest
+}
+
+func (w lockedWriter) Write(data []byte) (int, error) {
+	w.u.lock.Lock()
+	defer w.u.lock.Unlock()
+	if w.u.manifest != w.manifest {
+		return 0, errors.New("update aborted")
+	}
+	return w.u.write(data)
+}
+
+func (u *updater) fetch(manifest *Manifest) {
+	client := http.Client{Timeout: downloadTimeout}
+	logger.Debug("downloading update from ", manifest.Url)
+	resp, err := client.Get(manifest.Url)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = errors.New("could not download update: " + resp.Status)
+		} else {
+			_, err = io.Copy(lockedWriter{u, manifest}, resp.Body)
+		}
+	}
+	if err != nil {
+		u.lock.Lock()
+		if u.manifest == manifest {
+			u.abort(err)
+		}
+		u.lock.Unlock()
+		return
+	}
+	u.finish(manifest)
+}
+
+// finish verifies and installs the complete download of manifest, then
+// restarts the executable.
+func (u *updater) finish(manifest *Manifest) {
+	u.lock.Lock()
+	if u.manifest != manifest {
+		u.lock.Unlock()
+		return
+	}
+	if u.received != manifest.Size {
+		u.abort(errors.New("update is smaller than announced"))
+		u.lock.Unlock()
+		return
+	}
+	u.publishStatus(Status{State: StateVerifying, Version: manifest.Version, Progress: 100})
+	err := u.download.Sync()
+	if err == nil {
+		err = u.download.Close()
+	}
+	if err == nil {
+		err = verify(downloadPath(u.executable), manifest, u.publicKey)
+	}
+	if err == nil {
+		u.publishStatus(Status{State: StateInstalling, Version: manifest.Version, Progress: 100})
+		err = install(u.executable)
+	}
+	if err == nil {
+		err = writePendingUpdate(u.executable, &pendingUpdate{Version: manifest.Version, PreviousVersion: u.version})
+	}
+	if err != nil {
+		u.abort(err)
+		u.lock.Unlock()
+		return
+	}
+	logger.Info("update to version ", manifest.Version, " installed: restarting")
+	u.publishStatus(Status{State: StateRestarting, Version: manifest.Version, Progress: 100})
+	u.manifest = nil
+	u.download = nil
+	u.lock.Unlock()
+	u.restart(u.executable)
+}
+
+// abort cancels the update in progress. It must be called with the lock held.
+func (u *updater) abort(err error) error {
+	if u.download != nil {
+		u.download.Close()
+		os.Remove(downloadPath(u.executable))
+	}
+	u.download = nil
+	u.manifest = nil
+	return u.fail(err)
+}
+
+func (u *updater) fail(err error) error {
+	logger.Error("update failed: ", err)
+	u.publishStatus(Status{State: StateFailed, Version: u.version, Error: err.Error()})
+	return err
+}
+
+func (u *updater) publishStatus(status Status) {
+	buf, _ := json.Marshal(status)
+	u.publish(string(buf))
+}
+
+// verifyManifest checks that the version and the checksum of the manifest
+// are signed by publicKey.
+func verifyManifest(manifest *Manifest, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid update public key")
+	}
+	expected, err := hex.DecodeString(manifest.Sha256)
+	if err != nil || len(expected) != sha256.Size {
+		return errors.New("invalid update checksum encoding")
+	}
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return errors.New("invalid update signature encoding")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), signedMessage(manifest.Version, expected), signature) {
+		return errors.New("invalid update signature")
+	}
+	return nil
+}
+
+// verify checks that the file at path matches the manifest checksum, and
+// that the manifest is signed by publicKey.
+func verify(path string, manifest *Manifest, publicKey string) error {
+	if err := verifyManifest(manifest, publicKey); err != nil {
+		return err
+	}
+	digest, err := checksum(path)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(digest) != strings.ToLower(manifest.Sha256) {
+		return errors.New("update checksum mismatch")
+	}
+	return nil
+}
+
+// signedMessage returns the message signed by the manifest of a version.
+func signedMessage(version string, digest []byte) []byte {
+	return []byte(version + "\n" + hex.EncodeToString(digest))
+}
+
+// parseVersion parses versions such as "1.2.0" or "v1.2.0-rc1", ignoring
+// the pre-release suffix.
+func parseVersion(version string) ([]int, error) {
+	version = strings.SplitN(strings.TrimPrefix(version, "v"), "-", 2)[0]
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for idx, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, errors.New("invalid version " + version)
+		}
+		numbers[idx] = number
+	}
+	return numbers, nil
+}
+
+// checkNewer returns an error unless candidate is newer than current.
+// Development builds, without a parseable version, accept any version.
+func checkNewer(candidate string, current string) error {
+	next, err := parseVersion(candidate)
+	if err != nil {
+		return errors.New("invalid update version: " + err.Error())
+	}
+	running, err := parseVersion(current)
+	if err != nil {
+		logger.Warn("running version ", current, " cannot be compared: accepting version ", candidate)
+		return nil
+	}
+	for idx := 0; idx < len(next) || idx < len(running); idx++ {
+		a, b := 0, 0
+		if idx < len(next) {
+			a = next[idx]
+		}
+		if idx < len(running) {
+			b = running[idx]
+		}
+		if a != b {
+			if a > b {
+				return nil
+			}
+			break
+		}
+	}
+	return errors.New("update version " + candidate + " is not newer than the running version " + current)
+}
@@ -0,0 +1,127 @@
+package ota
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	public, private, _ := ed25519.GenerateKey(nil)
+	binary := []byte("new binary")
+	digest := sha256.Sum256(binary)
+	path := filepath.Join(dir, "binary")
+	ioutil.WriteFile(path, binary, 0700)
+	manifest := &Manifest{
+		Version:   "1.0.0",
+		Size:      int64(len(binary)),
+		Sha256:    hex.EncodeToString(digest[:]),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(private, signedMessage("1.0.0", digest[:]))),
+	}
+	publicKey := base64.StdEncoding.EncodeToString(public)
+	if err := verify(path, manifest, publicKey); err != nil {
+		t.Error("verify should accept a signed binary: got ", err)
+	}
+	ioutil.WriteFile(path, []byte("tampered binary"), 0700)
+	if err := verify(path, manifest, publicKey); err == nil {
+		t.Error("verify should reject a binary not matching the checksum")
+	}
+	replayed := *manifest
+	replayed.Version = "2.0.0"
+	if err := verify(path, &replayed, publicKey); err == nil {
+		t.Error("verify should reject a signature made for another version")
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	ioutil.WriteFile(path, binary, 0700)
+	if err := verify(path, manifest, base64.StdEncoding.EncodeToString(other)); err == nil {
+		t.Error("verify should reject a binary signed by another key")
+	}
+}
+
+func TestCheckNewer(t *testing.T) {
+	for _, newer := range [][]string{{"1.2.1", "1.2.0"}, {"v1.10.0", "1.9.3"}, {"2.0", "1.9.9"}, {"1.0.0", "dev"}} {
+		if err := checkNewer(newer[0], newer[1]); err != nil {
+			t.Error("checkNewer should accept ", newer[0], " over ", newer[1], ": got ", err)
+		}
+	}
+	for _, older := range [][]string{{"1.2.0", "1.2.0"}, {"1.1.9", "1.2.0"}, {"1.2", "1.2.0"}, {"latest", "1.2.0"}} {
+		if err := checkNewer(older[0], older[1]); err == nil {
+			t.Error("checkNewer should reject ", older[0], " over ", older[1])
+		}
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	executable := filepath.Join(dir, "weathercontroller")
+	ioutil.WriteFile(executable, []byte("old"), 0755)
+	ioutil.WriteFile(downloadPath(executable), []byte("new"), 0700)
+	if err := install(executable); err != nil {
+		t.Fatal("install should replace the executable: got ", err)
+	}
+	if buf, _ := ioutil.ReadFile(executable); string(buf) != "new" {
+		t.Error("install should move the download in place of the executable: got ", string(buf))
+	}
+	if buf, _ := ioutil.ReadFile(previousPath(executable)); string(buf) != "old" {
+		t.Error("install should keep the previous executable: got ", string(buf))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	public, private, _ := ed25519.GenerateKey(nil)
+	u := &updater{
+		version:    "1.0.0",
+		publicKey:  base64.StdEncoding.EncodeToString(public),
+		executable: filepath.Join(dir, "weathercontroller"),
+		publish:    func(status string) {},
+		restart:    func(executable string) {},
+		timeout:    50 * time.Millisecond,
+	}
+	digest := sha256.Sum256([]byte("new binary"))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, signedMessage("1.1.0", digest[:])))
+	forged := `{"version": "1.1.0", "size": 10, "sha256": "` + hex.EncodeToString(digest[:]) + `", "signature": "` + base64.StdEncoding.EncodeToString(make([]byte, 64)) + `", "url": "http://192.0.2.10/update"}`
+	if err := u.Update(forged); err == nil {
+		t.Error("Update should reject an invalid signature before downloading")
+	}
+	if _, err := os.Stat(downloadPath(u.executable)); !os.IsNotExist(err) {
+		t.Error("Update should not open the download before the signature is verified: got ", err)
+	}
+	oversized := `{"version": "1.1.0", "size": 1099511627776, "sha256": "` + hex.EncodeToString(digest[:]) + `", "signature": "` + signature + `"}`
+	if err := u.Update(oversized); err == nil {
+		t.Error("Update should reject a size above the maximum")
+	}
+	chunked := `{"version": "1.1.0", "size": 10, "sha256": "` + hex.EncodeToString(digest[:]) + `", "signature": "` + signature + `"}`
+	if err := u.Update(chunked); err != nil {
+		t.Fatal("Update should accept a signed manifest: got ", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	u.lock.Lock()
+	stalled := u.manifest != nil
+	u.lock.Unlock()
+	if stalled {
+		t.Error("a stalled update should be aborted")
+	}
+	if err := u.Update(chunked); err != nil {
+		t.Error("an update should be accepted once a stalled one is aborted: got ", err)
+	}
+}
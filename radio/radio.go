@@ -3,9 +3,13 @@ package radio
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/jbonachera/rfm69"
 	"github.com/jbonachera/weathercontroller/log"
+	"sync"
+	"sync/atomic"
 )
 
 type Metric struct {
@@ -21,88 +25,171 @@ func (metric *Metric) Dump() string {
 	return fmt.Sprintf("Temperature: %f, Humidity: %f, Pressure: %f, Battery: %f, RSSI: %d, Uptime: %d", metric.Temperature, metric.Humidity, metric.Pressure, metric.Battery, metric.RSSI, metric.Uptime)
 }
 
+// Settings configure the radio. Frequency is the band, such as "433", and
+// EncryptionKey the 16 bytes AES key shared with the sensors. Promiscuous
+// clients process the packets addressed to other nodes, and Ack enables the
+// acknowledgement of the non-broadcast packets requesting one.
+type Settings struct {
+	NetworkId     int
+	ClientId      int
+	Frequency     string
+	EncryptionKey string
+	Promiscuous   bool
+	Ack           bool
+}
+
 type Client interface {
-	Start(encryptionKey string, frequency string) error
+	Start() error
 	Stop() error
+	Reconfigure(settings Settings) error
+	SetLogger(logger *log.Logger)
 }
 
 type client struct {
-	rfm       *rfm69.Device
-	networkId int
-	clientId  int
-	running   bool
-	callback  func(sensorId byte, metric Metric)
-	stopped   chan bool
-	stop      chan bool
+	// lock serializes Start, Stop and Reconfigure
+	lock     sync.Mutex
+	rfm      *rfm69.Device
+	settings Settings
+	running  uint32 // accessed atomically
+	callback func(correlationId string, sensorId byte, metric Metric)
+	stopped  chan bool
+	stop     chan bool
+	logger   *log.Logger
 }
 
-func NewClient(networkId int, clientId int, callback func(sensorId byte, metric Metric)) Client {
-	newClient := &client{rfm: nil, networkId: networkId, clientId: clientId, running: false, callback: callback}
+// NewClient creates a radio client. callback is called for each metric
+// received, with a correlation id identifying the packet in the logs.
+// Messages are logged by logger, or by the "radio" logger when nil.
+func NewClient(settings Settings, callback func(correlationId string, sensorId byte, metric Metric), logger *log.Logger) Client {
+	if logger == nil {
+		logger = log.Named("radio")
+	}
+	newClient := &client{rfm: nil, settings: settings, callback: callback, logger: logger}
 	return newClient
 }
 
-func (c *client) Start(encryptionKey string, frequency string) error {
+func (c *client) isRunning() bool {
+	return atomic.LoadUint32(&c.running) == 1
+}
+
+func (c *client) SetLogger(logger *log.Logger) {
+	c.logger = logger
+}
+
+func (c *client) Start() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.startRadio()
+}
+
+func (c *client) startRadio() error {
 	var err error
-	log.Debug("creating radio driver")
-	c.rfm, err = rfm69.NewDevice(byte(c.clientId), byte(c.networkId), true)
+	c.logger.Debug("creating radio driver")
+	c.rfm, err = rfm69.NewDevice(byte(c.settings.ClientId), byte(c.settings.NetworkId), true)
 	if err != nil {
 		return err
 	}
-	log.Debug("configuring encryption key")
-	err = c.rfm.Encrypt([]byte(encryptionKey))
+	c.logger.Debug("configuring encryption key")
+	err = c.rfm.Encrypt([]byte(c.settings.EncryptionKey))
 	if err != nil {
-		panic(err)
+		c.rfm.Close()
+		return err
 	}
-	log.Debug("setting radio frequency")
-	c.rfm.SetFrequency(frequency)
-	log.Debug("enabling radio receive mode")
+	c.logger.Debug("setting radio frequency")
+	c.rfm.SetFrequency(c.settings.Frequency)
+	c.logger.Debug("enabling radio receive mode")
 	c.rfm.SetMode(rfm69.RF_OPMODE_RECEIVER)
-	go c.loop()
+	c.stopped = make(chan bool, 1)
+	c.stop = make(chan bool, 1)
+	atomic.StoreUint32(&c.running, 1)
+	go c.loop(c.settings)
 	return nil
 }
 func (c *client) Stop() error {
-	log.Info("stopping radio subsystem")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stopRadio()
+}
+
+func (c *client) stopRadio() error {
+	if c.stop == nil || !c.isRunning() {
+		return nil
+	}
+	c.logger.Info("stopping radio subsystem")
 	c.stop <- true
 	for {
 		select {
 		case <-c.stopped:
-			log.Info("radio subsystem")
+			c.logger.Info("radio subsystem")
 			return nil
 		}
 	}
 
 }
 
-func (c *client) loop() {
+// loop processes the received packets. It is given a copy of the settings,
+// which Reconfigure replaces once the loop is stopped.
+func (c *client) loop(settings Settings) {
 	rx := make(chan *rfm69.Data, 5)
-	c.stopped = make(chan bool, 1)
-	c.stop = make(chan bool, 1)
 
 	c.rfm.OnReceive = func(d *rfm69.Data) {
 		rx <- d
 	}
-	log.Info("radio subsystem started")
-	c.running = true
-	for c.running {
+	c.logger.Info("radio subsystem started")
+	for c.isRunning() {
 		select {
 		case data := <-rx:
-			if data.ToAddress != 255 && data.RequestAck {
-				log.Debug("ACK sent")
+			correlationId := uuid.New().String()
+			entry := c.logger.WithFields(log.Fields{log.CorrelationKey: correlationId, "sensor": data.FromAddress})
+			entry.Trace("packet received")
+			if data.ToAddress != 255 && data.ToAddress != byte(settings.ClientId) && !settings.Promiscuous {
+				entry.Trace("dropping packet addressed to node ", data.ToAddress)
+				continue
+			}
+			if data.ToAddress != 255 && data.RequestAck && settings.Ack {
+				entry.Debug("ACK sent")
 				c.rfm.Send(data.ToAck())
 			}
 			buf := bytes.NewReader(data.Data)
 			var payload Metric = Metric{}
 			err := binary.Read(buf, binary.LittleEndian, &payload)
 			if err != nil {
-				log.Error(err.Error())
+				entry.Error(err.Error())
 			} else {
-				c.callback(data.FromAddress, payload)
+				c.callback(correlationId, data.FromAddress, payload)
 			}
 		case <-c.stop:
-			c.running = false
+			atomic.StoreUint32(&c.running, 0)
 		}
 
 	}
 	c.rfm.Close()
 	c.stopped <- true
 }
+
+// Reconfigure applies new settings, restarting the radio if it is running,
+// or once started otherwise.
+// If the radio cannot start with the new settings, it is restarted with the
+// previous ones and an error is returned.
+func (c *client) Reconfigure(settings Settings) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.isRunning() {
+		c.settings = settings
+		return nil
+	}
+	c.logger.Info("configuration changed: restarting")
+	c.stopRadio()
+	previous := c.settings
+	c.settings = settings
+	err := c.startRadio()
+	if err == nil {
+		return nil
+	}
+	c.logger.Error("new configuration failed: rolling back to previous configuration")
+	c.settings = previous
+	if rollbackErr := c.startRadio(); rollbackErr != nil {
+		c.logger.Error("could not restore previous configuration: ", rollbackErr)
+	}
+	return errors.New("new radio configuration rolled back: " + err.Error())
+}
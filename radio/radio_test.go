@@ -0,0 +1,14 @@
+package radio
+
+import "testing"
+
+func TestReconfigureStopped(t *testing.T) {
+	c := NewClient(Settings{NetworkId: 100, ClientId: 1, Frequency: "433"}, nil, nil).(*client)
+	settings := Settings{NetworkId: 101, ClientId: 2, Frequency: "868", Promiscuous: true}
+	if err := c.Reconfigure(settings); err != nil {
+		t.Error("Reconfigure should accept settings before the radio is started: got ", err)
+	}
+	if c.settings != settings || c.isRunning() {
+		t.Error("Reconfigure should keep the settings for the next start, without starting the radio: got ", c.settings)
+	}
+}